@@ -0,0 +1,210 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 予約枠は1時間単位
+const reservationSlotDuration = 60 * 60
+
+type PostReservationSeasonRequest struct {
+	Name    string `json:"name"`
+	StartAt int64  `json:"start_at"`
+	EndAt   int64  `json:"end_at"`
+	// 生成する予約枠ごとの同時配信数
+	Capacity int64 `json:"capacity"`
+}
+
+type PutReservationSlotCapacityRequest struct {
+	StartAt  int64 `json:"start_at"`
+	EndAt    int64 `json:"end_at"`
+	Capacity int64 `json:"capacity"`
+}
+
+// verifyAdmin は管理APIのトークンを検証する。トークンが設定されていなければ管理APIは使えない
+func verifyAdmin(c echo.Context) error {
+	if len(adminToken) == 0 {
+		return echo.NewHTTPError(http.StatusForbidden, "admin API is disabled")
+	}
+	token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+	if !ok || subtle.ConstantTimeCompare([]byte(token), adminToken) != 1 {
+		return echo.NewHTTPError(http.StatusUnauthorized, "invalid admin token")
+	}
+	return nil
+}
+
+// validateSlotRange は1時間単位で区切られた区間か調べる
+func validateSlotRange(startAt, endAt int64) error {
+	if startAt >= endAt || startAt%reservationSlotDuration != 0 || endAt%reservationSlotDuration != 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "start_at and end_at must be on the hour and start_at must be before end_at")
+	}
+	return nil
+}
+
+func getReservationSeasonsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	seasons := []ReservationSeasonModel{}
+	if err := dbConn.SelectContext(ctx, &seasons, "SELECT * FROM reservation_seasons ORDER BY start_at"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_seasons: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, seasons)
+}
+
+// postReservationSeasonHandler はシーズンを開き、その期間の1時間ごとの予約枠を作る
+func postReservationSeasonHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	var req *PostReservationSeasonRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is required")
+	}
+	if req.Capacity < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "capacity must not be negative")
+	}
+	if err := validateSlotRange(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var seasons []ReservationSeasonModel
+	if err := tx.SelectContext(ctx, &seasons, "SELECT * FROM reservation_seasons"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_seasons: "+err.Error())
+	}
+	for _, season := range seasons {
+		if req.StartAt < season.EndAt && req.EndAt > season.StartAt {
+			return echo.NewHTTPError(http.StatusConflict, "the season overlaps with "+season.Name)
+		}
+	}
+
+	season := ReservationSeasonModel{
+		Name:    req.Name,
+		StartAt: req.StartAt,
+		EndAt:   req.EndAt,
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_seasons (name, start_at, end_at) VALUES (:name, :start_at, :end_at)", season)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation_season: "+err.Error())
+	}
+	if season.ID, err = rs.LastInsertId(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reservation_season id: "+err.Error())
+	}
+
+	// シーズンの外に作られた予約枠が既にあれば、それはそのまま使う
+	var existingSlots []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &existingSlots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	existing := make(map[int64]struct{}, len(existingSlots))
+	for _, slot := range existingSlots {
+		existing[slot.StartAt] = struct{}{}
+	}
+	var slots []ReservationSlotModel
+	for startAt := req.StartAt; startAt < req.EndAt; startAt += reservationSlotDuration {
+		if _, ok := existing[startAt]; !ok {
+			slots = append(slots, ReservationSlotModel{Slot: req.Capacity, StartAt: startAt, EndAt: startAt + reservationSlotDuration})
+		}
+	}
+	// 複数行のINSERTはキャッシュの計画に載らないので1行ずつ入れる
+	for _, slot := range slots {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (:slot, :start_at, :end_at)", slot); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reservation_slot: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	promoteWaitlist(ctx, c, req.StartAt, req.EndAt)
+
+	return c.JSON(http.StatusCreated, season)
+}
+
+// putReservationSlotCapacityHandler は区間内の予約枠の同時配信数を変える。
+// 残数は新しい同時配信数からキャンセルされていない予約済みの配信数を引いたものにする
+func putReservationSlotCapacityHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyAdmin(c); err != nil {
+		return err
+	}
+
+	var req *PutReservationSlotCapacityRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if req.Capacity < 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "capacity must not be negative")
+	}
+	if err := validateSlotRange(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 予約と並行して変えないようにロックを取る
+	var slots []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	if len(slots) == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "no reservation slots in the given range")
+	}
+
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams l WHERE l.start_at < ? AND l.end_at > ? AND NOT EXISTS (SELECT 1 FROM livestream_states s WHERE s.livestream_id = l.id AND s.status = ?)", req.EndAt, req.StartAt, livestreamStatusCancelled); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	res := make([]ReservationSlot, len(slots))
+	for i, slot := range slots {
+		// 予約時の UPDATE reservation_slots と同じく、配信の期間に含まれる予約枠を予約済みとする
+		var reserved int64
+		for _, livestreamModel := range livestreamModels {
+			if slot.StartAt >= livestreamModel.StartAt && slot.EndAt <= livestreamModel.EndAt {
+				reserved++
+			}
+		}
+		remaining := max(req.Capacity-reserved, 0)
+		if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = ? WHERE start_at = ? AND end_at = ?", remaining, slot.StartAt, slot.EndAt); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+		}
+		res[i] = ReservationSlot{StartAt: slot.StartAt, EndAt: slot.EndAt, Slot: remaining}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	promoteWaitlist(ctx, c, req.StartAt, req.EndAt)
+
+	return c.JSON(http.StatusOK, res)
+}
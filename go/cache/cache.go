@@ -4,7 +4,12 @@ import (
 	"context"
 	"database/sql/driver"
 	"fmt"
+	"log"
 	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/traP-jp/isuc/normalizer"
 )
 
 type (
@@ -13,11 +18,22 @@ type (
 	argsKey           struct{}
 	queryerCtxKey     struct{}
 	namedValueArgsKey struct{}
+	preloadKey        struct{}
+	fillKey           struct{}
 )
 
+// cacheFill is passed from a read of a cache to its fill
+type cacheFill struct {
+	// uniqueOnly is true if the cache is looked up by the primary key; such caches are not purged on inserts,
+	// so a key not found is not cached (the row may be inserted later)
+	uniqueOnly bool
+	// missed is set when the read fills the cache itself
+	missed bool
+}
+
 func ExportMetrics() string {
 	res := ""
-	for query, cache := range caches {
+	for query, cache := range loadPlan().caches {
 		stats := cache.cache.Stats()
 		progress := "["
 		for i := 0; i < 20; i++ {
@@ -27,9 +43,10 @@ func ExportMetrics() string {
 				progress += "-"
 			}
 		}
-		statsStr := fmt.Sprintf("%s (%.2f%% - %d/%d) (%d replace) (size %d)", progress, stats.HitRatio()*100, stats.Hits, stats.Misses+stats.Hits, stats.Replacements, stats.Size)
+		statsStr := fmt.Sprintf("%s (%.2f%% - %d/%d) (%d replace) (size %d) (bytes %d)", progress, stats.HitRatio()*100, stats.Hits, stats.Misses+stats.Hits, stats.Replacements, stats.Size, cache.memory.usage())
 		res += fmt.Sprintf("query: \"%s\"\n%s\n\n", query, statsStr)
 	}
+	res += fmt.Sprintf("total bytes: %d (limit %d)\n", totalBytes.Load(), totalLimit.Load())
 	return res
 }
 
@@ -38,26 +55,45 @@ type CacheStats struct {
 	HitRatio float64
 	Hits     int
 	Misses   int
+	Bytes    int64
 }
 
 func ExportCacheStats() map[string]CacheStats {
 	res := make(map[string]CacheStats)
-	for query, cache := range caches {
+	for query, cache := range loadPlan().caches {
 		stats := cache.cache.Stats()
 		res[query] = CacheStats{
 			Query:    query,
 			HitRatio: stats.HitRatio(),
 			Hits:     int(stats.Hits),
 			Misses:   int(stats.Misses),
+			Bytes:    cache.memory.usage(),
 		}
 	}
 	return res
 }
 
 func PurgeAllCaches() {
-	for _, cache := range caches {
-		cache.cache.Purge()
+	for _, cache := range loadPlan().caches {
+		cache.purge()
 	}
+	invalidateReplicas()
+}
+
+// epoch is bumped by Initialize; rows fetched across a bump are returned but not cached
+var epoch atomic.Uint64
+
+// Initialize resets the driver after the database has been reloaded behind its back (e.g. by init.sh).
+// Every cache, replica and write-behind id counter is dropped, the cache and digest statistics start over,
+// and fills still in flight are not stored since they may have read the old data.
+// Write-behind queues must be flushed before the database is reloaded.
+func Initialize() {
+	epoch.Add(1)
+	resetCaches()
+	invalidateReplicas()
+	resetWriteBehindIDs()
+	resetDigest()
+	log.Println("cache: initialized")
 }
 
 func cacheName(query string) string {
@@ -82,30 +118,88 @@ func cacheKey(args []driver.Value) string {
 }
 
 func replaceFn(ctx context.Context, key string) (*cacheRows, error) {
+	if rows, ok := ctx.Value(preloadKey{}).(*cacheRows); ok {
+		// rows restored from a snapshot
+		return rows, nil
+	}
+
+	fill, _ := ctx.Value(fillKey{}).(*cacheFill)
+	if fill != nil {
+		fill.missed = true
+	}
+	start := epoch.Load()
+	fetchedAt := time.Now()
+	rows, err := fetchRows(ctx)
+	if err != nil {
+		return nil, err
+	}
+	rows.fetchedAt = fetchedAt
+	if fill != nil && fill.uniqueOnly && len(rows.rows.rows) == 0 {
+		return nil, &uncacheableError{rows: rows}
+	}
+	if epoch.Load() != start {
+		// the database was reinitialized during the fetch
+		return nil, &uncacheableError{rows: rows}
+	}
+	return rows, nil
+}
+
+func fetchRows(ctx context.Context) (*cacheRows, error) {
 	queryerCtx, ok := ctx.Value(queryerCtxKey{}).(driver.QueryerContext)
 	if ok {
 		query := ctx.Value(queryKey{}).(string)
 		nvargs := ctx.Value(namedValueArgsKey{}).([]driver.NamedValue)
+		if err := flushWriteBehindFor(ctx, query); err != nil {
+			return nil, err
+		}
+		start := time.Now()
 		rows, err := queryerCtx.QueryContext(ctx, query, nvargs)
+		r := routeOf(queryerCtx)
+		recordDigest(ctx, normalizer.NormalizeQuery(query), r, time.Since(start))
 		if err != nil {
 			return nil, err
 		}
+		defer rows.Close()
 		cacheRows, err := newCacheRows(rows)
 		if err != nil {
 			return nil, err
 		}
+		cacheRows.fromReplica = r == routeReadReplica
+		if cacheRows.uncacheable {
+			return nil, &uncacheableError{rows: cacheRows}
+		}
 		return cacheRows.clone(), nil
 	}
 
 	stmt := ctx.Value(stmtKey{}).(*customCacheStatement)
 	args := ctx.Value(argsKey{}).([]driver.Value)
-	rows, err := stmt.inner.Query(args)
+	if err := flushWriteBehindFor(ctx, stmt.query); err != nil {
+		return nil, err
+	}
+	start := time.Now()
+	var rows driver.Rows
+	var err error
+	fromReplica := false
+	if stmt.conn.readFromReplica(ctx) {
+		queryer, r := stmt.conn.readQueryer(ctx)
+		rows, err = queryer.QueryContext(ctx, stmt.rawQuery, valueToNamedValue(args))
+		recordDigest(ctx, stmt.query, r, time.Since(start))
+		fromReplica = r == routeReadReplica
+	} else {
+		rows, err = stmt.inner.Query(args)
+		recordDigest(ctx, stmt.query, routePrimary, time.Since(start))
+	}
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 	cacheRows, err := newCacheRows(rows)
 	if err != nil {
 		return nil, err
 	}
+	cacheRows.fromReplica = fromReplica
+	if cacheRows.uncacheable {
+		return nil, &uncacheableError{rows: cacheRows}
+	}
 	return cacheRows.clone(), nil
 }
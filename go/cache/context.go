@@ -0,0 +1,52 @@
+package cache
+
+import (
+	"context"
+	"time"
+)
+
+type (
+	bypassKey       struct{}
+	maxStalenessKey struct{}
+	tagKey          struct{}
+	sessionKey      struct{}
+)
+
+// WithBypass makes the queries run with ctx read MySQL (the primary) directly,
+// skipping the caches, the replicated tables and the read replica.
+func WithBypass(ctx context.Context) context.Context {
+	return context.WithValue(ctx, bypassKey{}, true)
+}
+
+// WithMaxStaleness makes the queries run with ctx refetch cached rows fetched more than d ago.
+func WithMaxStaleness(ctx context.Context, d time.Duration) context.Context {
+	return context.WithValue(ctx, maxStalenessKey{}, d)
+}
+
+// WithTag attributes the cache hits, misses and database time of the queries run with ctx to tag,
+// e.g. the route of the HTTP request. The stats are read by ExportTagStats.
+func WithTag(ctx context.Context, tag string) context.Context {
+	return context.WithValue(ctx, tagKey{}, tag)
+}
+
+// WithSession makes the queries run with ctx read the primary for a while after a write made with the same session,
+// instead of only after a write made by anyone. Queries without a session share a single window.
+func WithSession(ctx context.Context, session string) context.Context {
+	return context.WithValue(ctx, sessionKey{}, session)
+}
+
+func sessionOf(ctx context.Context) string {
+	session, _ := ctx.Value(sessionKey{}).(string)
+	return session
+}
+
+func bypassed(ctx context.Context) bool {
+	bypass, _ := ctx.Value(bypassKey{}).(bool)
+	return bypass
+}
+
+// tooStale reports whether rows are older than the staleness allowed by ctx.
+func tooStale(ctx context.Context, rows *cacheRows) bool {
+	d, ok := ctx.Value(maxStalenessKey{}).(time.Duration)
+	return ok && time.Since(rows.fetchedAt) > d
+}
@@ -0,0 +1,156 @@
+package cache
+
+import (
+	"cmp"
+	"context"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/traP-jp/isuc/domains"
+)
+
+// route is where a query was answered
+type route string
+
+const (
+	routePrimary     route = "primary"
+	routeReadReplica route = "read_replica"
+	routeCache       route = "cache"
+	routeMemory      route = "memory" // in-memory replica of a replicated table
+	routeWriteBehind route = "write_behind"
+)
+
+func writeRoute(plan *cachePlan, queryInfo domains.CachePlanQuery) route {
+	if queryInfo.Type == domains.CachePlanQueryType_INSERT && plan.tables[queryInfo.Insert.Table].WriteBehind {
+		return routeWriteBehind
+	}
+	return routePrimary
+}
+
+// QueryDigest is the aggregated execution statistics of a normalized query.
+// A read through the cache is counted under "cache", and its fill on a miss under the backend it was sent to.
+type QueryDigest struct {
+	Query     string
+	Count     int64
+	TotalTime time.Duration
+	// Routes counts the executions by where they were answered
+	Routes map[string]int64
+}
+
+// TagStats is the cache usage of the queries run with a context given by WithTag.
+type TagStats struct {
+	Tag string
+	// Hits and Misses count the reads of cached queries and replicated tables
+	Hits   int64
+	Misses int64
+	// Queries is the number of queries sent to MySQL, and DBTime is the time spent on them
+	Queries int64
+	DBTime  time.Duration
+}
+
+var digests = struct {
+	mu      sync.Mutex
+	queries map[string]*QueryDigest
+	tags    map[string]*TagStats
+}{
+	queries: make(map[string]*QueryDigest),
+	tags:    make(map[string]*TagStats),
+}
+
+func recordDigest(ctx context.Context, query string, r route, elapsed time.Duration) {
+	digests.mu.Lock()
+	defer digests.mu.Unlock()
+	d, ok := digests.queries[query]
+	if !ok {
+		d = &QueryDigest{Query: query, Routes: make(map[string]int64)}
+		digests.queries[query] = d
+	}
+	d.Count++
+	d.TotalTime += elapsed
+	d.Routes[string(r)]++
+
+	t := tagStatsLocked(ctx)
+	if t == nil {
+		return
+	}
+	switch r {
+	case routeMemory:
+		t.Hits++
+	case routePrimary, routeReadReplica:
+		t.Queries++
+		t.DBTime += elapsed
+	}
+}
+
+// recordCacheRead counts a read of a cached query against the tag of ctx.
+// A read that waited for a fill started by another read is counted as a hit.
+func recordCacheRead(ctx context.Context, hit bool) {
+	digests.mu.Lock()
+	defer digests.mu.Unlock()
+	t := tagStatsLocked(ctx)
+	if t == nil {
+		return
+	}
+	if hit {
+		t.Hits++
+	} else {
+		t.Misses++
+	}
+}
+
+// tagStatsLocked must be called with digests.mu held
+func tagStatsLocked(ctx context.Context) *TagStats {
+	tag, ok := ctx.Value(tagKey{}).(string)
+	if !ok {
+		return nil
+	}
+	t, ok := digests.tags[tag]
+	if !ok {
+		t = &TagStats{Tag: tag}
+		digests.tags[tag] = t
+	}
+	return t
+}
+
+func resetDigest() {
+	digests.mu.Lock()
+	defer digests.mu.Unlock()
+	clear(digests.queries)
+	clear(digests.tags)
+}
+
+// ExportQueryDigest returns the digest of every query executed through the driver, slowest in total first.
+func ExportQueryDigest() []QueryDigest {
+	digests.mu.Lock()
+	res := make([]QueryDigest, 0, len(digests.queries))
+	for _, d := range digests.queries {
+		copied := *d
+		copied.Routes = make(map[string]int64, len(d.Routes))
+		for r, n := range d.Routes {
+			copied.Routes[r] = n
+		}
+		res = append(res, copied)
+	}
+	digests.mu.Unlock()
+
+	slices.SortFunc(res, func(a, b QueryDigest) int {
+		return cmp.Compare(b.TotalTime, a.TotalTime)
+	})
+	return res
+}
+
+// ExportTagStats returns the stats of every tag given by WithTag, most time spent on MySQL first.
+func ExportTagStats() []TagStats {
+	digests.mu.Lock()
+	res := make([]TagStats, 0, len(digests.tags))
+	for _, t := range digests.tags {
+		res = append(res, *t)
+	}
+	digests.mu.Unlock()
+
+	slices.SortFunc(res, func(a, b TagStats) int {
+		return cmp.Compare(b.DBTime, a.DBTime)
+	})
+	return res
+}
@@ -7,20 +7,36 @@ import (
 	"fmt"
 	"io"
 	"log"
+	"reflect"
 	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/go-sql-driver/mysql"
-	"github.com/motoki317/sc"
 	"github.com/traP-jp/isuc/domains"
 	"github.com/traP-jp/isuc/normalizer"
 )
 
-var queryMap = make(map[string]domains.CachePlanQuery)
-
 var tableSchema = make(map[string]domains.TableSchema)
 
-const cachePlanRaw = `queries:
+const cachePlanRaw = `tables:
+  - table: reactions
+    write_behind: true
+  - table: livecomments
+    write_behind: true
+  - table: livestream_viewers_history
+    write_behind: true
+  - table: tags
+    replicated: true
+  - table: themes
+    replicated: true
+  - table: reservation_slots
+    replicated: true
+  - table: reservation_seasons
+    replicated: true
+  - table: users
+    replicated: true
+queries:
   - query: SELECT id FROM tags WHERE name = ?;
     type: select
     table: tags
@@ -295,6 +311,21 @@ const cachePlanRaw = `queries:
         operator: eq
         placeholder:
           index: 0
+  - query: SELECT * FROM users WHERE id IN (?);
+    type: select
+    table: users
+    cache: true
+    targets:
+      - password
+      - description
+      - id
+      - name
+      - display_name
+    conditions:
+      - column: id
+        operator: in
+        placeholder:
+          index: 0
   - query: SELECT image FROM icons WHERE user_id = ?;
     type: select
     table: icons
@@ -467,6 +498,24 @@ const cachePlanRaw = `queries:
         operator: eq
         placeholder:
           index: 0
+  - query: SELECT * FROM livestreams WHERE id IN (?);
+    type: select
+    table: livestreams
+    cache: true
+    targets:
+      - user_id
+      - title
+      - description
+      - playlist_url
+      - thumbnail_url
+      - start_at
+      - end_at
+      - id
+    conditions:
+      - column: id
+        operator: in
+        placeholder:
+          index: 0
   - query: SELECT IFNULL(SUM(l2.tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l.id = l2.livestream_id WHERE l.id = ?;
     type: select
     table: livestreams
@@ -647,6 +696,323 @@ const cachePlanRaw = `queries:
     type: select
     table: livestreams
     cache: false
+  - query: UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?;
+    type: update
+    table: reservation_slots
+    targets: []
+  - query: UPDATE livestreams SET title = ?, description = ?, playlist_url = ?, thumbnail_url = ?, start_at = ?, end_at = ? WHERE id = ?;
+    type: update
+    table: livestreams
+    targets:
+      - column: title
+        placeholder:
+          index: 0
+      - column: description
+        placeholder:
+          index: 1
+      - column: playlist_url
+        placeholder:
+          index: 2
+      - column: thumbnail_url
+        placeholder:
+          index: 3
+      - column: start_at
+        placeholder:
+          index: 4
+      - column: end_at
+        placeholder:
+          index: 5
+    conditions:
+      - column: id
+        operator: eq
+        placeholder:
+          index: 6
+  - query: DELETE FROM livestream_tags WHERE livestream_id = ?;
+    type: delete
+    table: livestream_tags
+    conditions:
+      - column: livestream_id
+        operator: eq
+        placeholder:
+          index: 0
+  - query: SELECT * FROM livestreams WHERE id = ? FOR UPDATE;
+    type: select
+    table: livestreams
+    cache: false
+  - query: INSERT INTO reservation_seasons (name, start_at, end_at) VALUES (?);
+    type: insert
+    table: reservation_seasons
+    columns:
+      - name
+      - start_at
+      - end_at
+  - query: INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (?);
+    type: insert
+    table: reservation_slots
+    columns:
+      - slot
+      - start_at
+      - end_at
+  - query: UPDATE reservation_slots SET slot = ? WHERE start_at = ? AND end_at = ?;
+    type: update
+    table: reservation_slots
+    targets:
+      - column: slot
+        placeholder:
+          index: 0
+    conditions:
+      - column: start_at
+        operator: eq
+        placeholder:
+          index: 1
+      - column: end_at
+        operator: eq
+        placeholder:
+          index: 2
+  - query: INSERT INTO reservation_waitlist (user_id, title, description, playlist_url, thumbnail_url, tags, collaborators, start_at, end_at, status, created_at) VALUES (?);
+    type: insert
+    table: reservation_waitlist
+    columns:
+      - user_id
+      - title
+      - description
+      - playlist_url
+      - thumbnail_url
+      - tags
+      - collaborators
+      - start_at
+      - end_at
+      - status
+      - created_at
+  - query: UPDATE reservation_waitlist SET status = ?, livestream_id = ? WHERE id = ?;
+    type: update
+    table: reservation_waitlist
+    targets:
+      - column: status
+        placeholder:
+          index: 0
+      - column: livestream_id
+        placeholder:
+          index: 1
+    conditions:
+      - column: id
+        operator: eq
+        placeholder:
+          index: 2
+  - query: SELECT * FROM reservation_waitlist WHERE id = ?;
+    type: select
+    table: reservation_waitlist
+    cache: false
+  - query: SELECT * FROM reservation_waitlist WHERE id = ? FOR UPDATE;
+    type: select
+    table: reservation_waitlist
+    cache: false
+  - query: SELECT * FROM reservation_waitlist WHERE user_id = ? ORDER BY id DESC;
+    type: select
+    table: reservation_waitlist
+    cache: false
+  - query: SELECT id FROM reservation_waitlist WHERE status = ? AND start_at < ? AND end_at > ? ORDER BY id;
+    type: select
+    table: reservation_waitlist
+    cache: false
+  - query: INSERT INTO livestream_series (user_id, frequency, occurrence_count, until_at, created_at) VALUES (?);
+    type: insert
+    table: livestream_series
+    columns:
+      - user_id
+      - frequency
+      - occurrence_count
+      - until_at
+      - created_at
+  - query: INSERT INTO livestream_series_livestreams (series_id, livestream_id) VALUES (?);
+    type: insert
+    table: livestream_series_livestreams
+    columns:
+      - series_id
+      - livestream_id
+  - query: SELECT * FROM livestream_series WHERE id = ?;
+    type: select
+    table: livestream_series
+    cache: false
+  - query: SELECT l.* FROM livestreams l INNER JOIN livestream_series_livestreams s ON s.livestream_id = l.id WHERE s.series_id = ? ORDER BY l.start_at;
+    type: select
+    table: livestreams
+    cache: false
+  - query: SELECT l.* FROM livestreams l INNER JOIN livestream_series_livestreams s ON s.livestream_id = l.id WHERE s.series_id = ? AND l.start_at > ? FOR UPDATE;
+    type: select
+    table: livestreams
+    cache: false
+  - query: SELECT COUNT(*) FROM livestreams l WHERE l.user_id = ? AND l.id != ? AND l.start_at < ? AND l.end_at > ? AND NOT EXISTS (SELECT 1 FROM livestream_states s WHERE s.livestream_id = l.id AND s.status = ?);
+    type: select
+    table: livestreams
+    cache: false
+  - query: SELECT COUNT(*) FROM livestreams l WHERE l.user_id = ? AND l.start_at > ? AND NOT EXISTS (SELECT 1 FROM livestream_states s WHERE s.livestream_id = l.id AND s.status = ?);
+    type: select
+    table: livestreams
+    cache: false
+  - query: SELECT * FROM livestream_cohosts WHERE livestream_id = ?;
+    type: select
+    table: livestream_cohosts
+    cache: true
+    targets:
+      - id
+      - livestream_id
+      - user_id
+      - status
+      - created_at
+    conditions:
+      - column: livestream_id
+        operator: eq
+        placeholder:
+          index: 0
+  - query: SELECT * FROM livestream_cohosts WHERE livestream_id IN (?);
+    type: select
+    table: livestream_cohosts
+    cache: true
+    targets:
+      - id
+      - livestream_id
+      - user_id
+      - status
+      - created_at
+    conditions:
+      - column: livestream_id
+        operator: in
+        placeholder:
+          index: 0
+  - query: INSERT INTO livestream_cohosts (livestream_id, user_id, status, created_at) VALUES (?);
+    type: insert
+    table: livestream_cohosts
+    columns:
+      - livestream_id
+      - user_id
+      - status
+      - created_at
+  - query: UPDATE livestream_cohosts SET status = ? WHERE id = ?;
+    type: update
+    table: livestream_cohosts
+    targets:
+      - column: status
+        placeholder:
+          index: 0
+    conditions:
+      - column: id
+        operator: eq
+        placeholder:
+          index: 1
+  - query: DELETE FROM livestream_cohosts WHERE id = ?;
+    type: delete
+    table: livestream_cohosts
+    conditions:
+      - column: id
+        operator: eq
+        placeholder:
+          index: 0
+  - query: SELECT l.* FROM livestreams l INNER JOIN livestream_cohosts h ON h.livestream_id = l.id WHERE h.user_id = ? AND h.status = ?;
+    type: select
+    table: livestreams
+    cache: false
+  - query: SELECT l.* FROM livestreams l INNER JOIN livestream_cohosts h ON h.livestream_id = l.id WHERE h.user_id = ? AND h.status = ? ORDER BY l.start_at;
+    type: select
+    table: livestreams
+    cache: false
+  - query: SELECT * FROM livestream_states WHERE livestream_id = ?;
+    type: select
+    table: livestream_states
+    cache: true
+    targets:
+      - id
+      - livestream_id
+      - status
+      - updated_at
+    conditions:
+      - column: livestream_id
+        operator: eq
+        placeholder:
+          index: 0
+  - query: SELECT * FROM livestream_states WHERE livestream_id IN (?);
+    type: select
+    table: livestream_states
+    cache: true
+    targets:
+      - id
+      - livestream_id
+      - status
+      - updated_at
+    conditions:
+      - column: livestream_id
+        operator: in
+        placeholder:
+          index: 0
+  - query: SELECT * FROM livestream_states WHERE livestream_id = ? AND status = ?;
+    type: select
+    table: livestream_states
+    cache: true
+    targets:
+      - id
+      - livestream_id
+      - status
+      - updated_at
+    conditions:
+      - column: livestream_id
+        operator: eq
+        placeholder:
+          index: 0
+      - column: status
+        operator: eq
+        placeholder:
+          index: 1
+  - query: INSERT INTO livestream_states (livestream_id, status, updated_at) VALUES (?);
+    type: insert
+    table: livestream_states
+    columns:
+      - livestream_id
+      - status
+      - updated_at
+  - query: UPDATE livestream_states SET status = ?, updated_at = ? WHERE livestream_id = ?;
+    type: update
+    table: livestream_states
+    targets:
+      - column: status
+        placeholder:
+          index: 0
+      - column: updated_at
+        placeholder:
+          index: 1
+    conditions:
+      - column: livestream_id
+        operator: eq
+        placeholder:
+          index: 2
+  - query: SELECT * FROM livestream_states;
+    type: select
+    table: livestream_states
+    cache: false
+  - query: SELECT * FROM livestreams l WHERE l.start_at < ? AND l.end_at > ? AND NOT EXISTS (SELECT 1 FROM livestream_states s WHERE s.livestream_id = l.id AND s.status = ?);
+    type: select
+    table: livestreams
+    cache: false
+  - query: INSERT INTO livestream_watch_times (user_id, livestream_id, watch_seconds, first_entered_at, last_seen_at) VALUES (?) ON DUPLICATE KEY UPDATE watch_seconds = watch_seconds + VALUES(watch_seconds), last_seen_at = GREATEST(last_seen_at, VALUES(last_seen_at));
+    type: insert
+    table: livestream_watch_times
+    columns:
+      - user_id
+      - livestream_id
+      - watch_seconds
+      - first_entered_at
+      - last_seen_at
+  - query: SELECT IFNULL(SUM(watch_seconds), 0) FROM livestream_watch_times WHERE livestream_id = ?;
+    type: select
+    table: livestream_watch_times
+    cache: false
+  - query: SELECT IFNULL(SUM(w.watch_seconds), 0) FROM livestreams l INNER JOIN livestream_watch_times w ON w.livestream_id = l.id WHERE l.user_id = ?;
+    type: select
+    table: livestreams
+    cache: false
+  - query: SELECT * FROM livestream_watch_times WHERE user_id = ?;
+    type: select
+    table: livestream_watch_times
+    cache: false
 `
 
 const schemaRaw = `USE ` + "`" + `isupipe` + "`" + `;
@@ -655,10 +1021,17 @@ DROP TABLE IF EXISTS ` + "`" + `users` + "`" + `;
 DROP TABLE IF EXISTS ` + "`" + `icons` + "`" + `;
 DROP TABLE IF EXISTS ` + "`" + `themes` + "`" + `;
 DROP TABLE IF EXISTS ` + "`" + `livestreams` + "`" + `;
+DROP TABLE IF EXISTS ` + "`" + `livestream_states` + "`" + `;
+DROP TABLE IF EXISTS ` + "`" + `livestream_series` + "`" + `;
+DROP TABLE IF EXISTS ` + "`" + `livestream_series_livestreams` + "`" + `;
+DROP TABLE IF EXISTS ` + "`" + `livestream_cohosts` + "`" + `;
 DROP TABLE IF EXISTS ` + "`" + `reservation_slots` + "`" + `;
+DROP TABLE IF EXISTS ` + "`" + `reservation_seasons` + "`" + `;
+DROP TABLE IF EXISTS ` + "`" + `reservation_waitlist` + "`" + `;
 DROP TABLE IF EXISTS ` + "`" + `tags` + "`" + `;
 DROP TABLE IF EXISTS ` + "`" + `livestream_tags` + "`" + `;
 DROP TABLE IF EXISTS ` + "`" + `livestream_viewers_history` + "`" + `;
+DROP TABLE IF EXISTS ` + "`" + `livestream_watch_times` + "`" + `;
 DROP TABLE IF EXISTS ` + "`" + `livecomments` + "`" + `;
 DROP TABLE IF EXISTS ` + "`" + `livecomment_reports` + "`" + `;
 DROP TABLE IF EXISTS ` + "`" + `ng_words` + "`" + `;
@@ -703,6 +1076,58 @@ CREATE TABLE ` + "`" + `livestreams` + "`" + ` (
   INDEX ` + "`" + `idx_user_id` + "`" + ` (` + "`" + `user_id` + "`" + `)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- 配信者の操作で決まったライブ配信の状態 (live, ended, cancelled)。行がなければ期間だけで決まる
+CREATE TABLE ` + "`" + `livestream_states` + "`" + ` (
+  ` + "`" + `id` + "`" + ` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  ` + "`" + `livestream_id` + "`" + ` BIGINT NOT NULL,
+  ` + "`" + `status` + "`" + ` VARCHAR(255) NOT NULL,
+  ` + "`" + `updated_at` + "`" + ` BIGINT NOT NULL,
+  UNIQUE ` + "`" + `uniq_livestream_id` + "`" + ` (` + "`" + `livestream_id` + "`" + `)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 繰り返し予約
+CREATE TABLE ` + "`" + `livestream_series` + "`" + ` (
+  ` + "`" + `id` + "`" + ` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  ` + "`" + `user_id` + "`" + ` BIGINT NOT NULL,
+  -- daily, weekly
+  ` + "`" + `frequency` + "`" + ` VARCHAR(255) NOT NULL,
+  -- 回数で指定されたとき以外は0
+  ` + "`" + `occurrence_count` + "`" + ` BIGINT NOT NULL DEFAULT 0,
+  -- 終わりの時刻で指定されたとき以外は0
+  ` + "`" + `until_at` + "`" + ` BIGINT NOT NULL DEFAULT 0,
+  ` + "`" + `created_at` + "`" + ` BIGINT NOT NULL,
+  INDEX ` + "`" + `idx_user_id` + "`" + ` (` + "`" + `user_id` + "`" + `)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 繰り返し予約とライブ配信の中間テーブル
+CREATE TABLE ` + "`" + `livestream_series_livestreams` + "`" + ` (
+  ` + "`" + `id` + "`" + ` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  ` + "`" + `series_id` + "`" + ` BIGINT NOT NULL,
+  ` + "`" + `livestream_id` + "`" + ` BIGINT NOT NULL,
+  INDEX ` + "`" + `idx_series_id` + "`" + ` (` + "`" + `series_id` + "`" + `),
+  INDEX ` + "`" + `idx_livestream_id` + "`" + ` (` + "`" + `livestream_id` + "`" + `)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信のコラボレーター
+CREATE TABLE ` + "`" + `livestream_cohosts` + "`" + ` (
+  ` + "`" + `id` + "`" + ` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  ` + "`" + `livestream_id` + "`" + ` BIGINT NOT NULL,
+  ` + "`" + `user_id` + "`" + ` BIGINT NOT NULL,
+  -- invited, accepted
+  ` + "`" + `status` + "`" + ` VARCHAR(255) NOT NULL,
+  ` + "`" + `created_at` + "`" + ` BIGINT NOT NULL,
+  UNIQUE ` + "`" + `uniq_livestream_id_user_id` + "`" + ` (` + "`" + `livestream_id` + "`" + `, ` + "`" + `user_id` + "`" + `),
+  INDEX ` + "`" + `idx_user_id` + "`" + ` (` + "`" + `user_id` + "`" + `)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信を予約できる期間 (シーズン)
+CREATE TABLE ` + "`" + `reservation_seasons` + "`" + ` (
+  ` + "`" + `id` + "`" + ` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  ` + "`" + `name` + "`" + ` VARCHAR(255) NOT NULL,
+  ` + "`" + `start_at` + "`" + ` BIGINT NOT NULL,
+  ` + "`" + `end_at` + "`" + ` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- ライブ配信予約枠
 CREATE TABLE ` + "`" + `reservation_slots` + "`" + ` (
   ` + "`" + `id` + "`" + ` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -712,6 +1137,29 @@ CREATE TABLE ` + "`" + `reservation_slots` + "`" + ` (
   INDEX ` + "`" + `start_at_end_at` + "`" + ` (` + "`" + `start_at` + "`" + `, ` + "`" + `end_at` + "`" + `)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- 予約枠のキャンセル待ち
+CREATE TABLE ` + "`" + `reservation_waitlist` + "`" + ` (
+  ` + "`" + `id` + "`" + ` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  ` + "`" + `user_id` + "`" + ` BIGINT NOT NULL,
+  ` + "`" + `title` + "`" + ` VARCHAR(255) NOT NULL,
+  ` + "`" + `description` + "`" + ` text NOT NULL,
+  ` + "`" + `playlist_url` + "`" + ` VARCHAR(255) NOT NULL,
+  ` + "`" + `thumbnail_url` + "`" + ` VARCHAR(255) NOT NULL,
+  -- 予約時に付けるタグIDのJSON配列
+  ` + "`" + `tags` + "`" + ` TEXT NOT NULL,
+  -- 予約時に招待するコラボレーターのユーザIDのJSON配列
+  ` + "`" + `collaborators` + "`" + ` TEXT NOT NULL,
+  ` + "`" + `start_at` + "`" + ` BIGINT NOT NULL,
+  ` + "`" + `end_at` + "`" + ` BIGINT NOT NULL,
+  -- waiting, reserved, expired, failed, cancelled
+  ` + "`" + `status` + "`" + ` VARCHAR(255) NOT NULL,
+  -- 予約された配信 (reservedのときのみ)
+  ` + "`" + `livestream_id` + "`" + ` BIGINT NOT NULL DEFAULT 0,
+  ` + "`" + `created_at` + "`" + ` BIGINT NOT NULL,
+  INDEX ` + "`" + `idx_status_start_at` + "`" + ` (` + "`" + `status` + "`" + `, ` + "`" + `start_at` + "`" + `),
+  INDEX ` + "`" + `idx_user_id` + "`" + ` (` + "`" + `user_id` + "`" + `)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- ライブストリームに付与される、サービスで定義されたタグ
 CREATE TABLE ` + "`" + `tags` + "`" + ` (
   ` + "`" + `id` + "`" + ` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -736,6 +1184,19 @@ CREATE TABLE ` + "`" + `livestream_viewers_history` + "`" + ` (
   ` + "`" + `created_at` + "`" + ` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- ライブ配信の視聴者ごとの視聴記録 (視聴履歴)
+CREATE TABLE ` + "`" + `livestream_watch_times` + "`" + ` (
+  ` + "`" + `id` + "`" + ` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  ` + "`" + `user_id` + "`" + ` BIGINT NOT NULL,
+  ` + "`" + `livestream_id` + "`" + ` BIGINT NOT NULL,
+  ` + "`" + `watch_seconds` + "`" + ` BIGINT NOT NULL,
+  ` + "`" + `first_entered_at` + "`" + ` BIGINT NOT NULL,
+  ` + "`" + `last_seen_at` + "`" + ` BIGINT NOT NULL,
+  UNIQUE ` + "`" + `uniq_user_livestream` + "`" + ` (` + "`" + `user_id` + "`" + `, ` + "`" + `livestream_id` + "`" + `),
+  INDEX ` + "`" + `idx_user_id_last_seen_at` + "`" + ` (` + "`" + `user_id` + "`" + `, ` + "`" + `last_seen_at` + "`" + `),
+  INDEX ` + "`" + `idx_livestream_id` + "`" + ` (` + "`" + `livestream_id` + "`" + `)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- ライブ配信に対するライブコメント
 CREATE TABLE ` + "`" + `livecomments` + "`" + ` (
   ` + "`" + `id` + "`" + ` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -791,46 +1252,17 @@ func init() {
 		tableSchema[table.TableName] = table
 	}
 
-	plan, err := domains.LoadCachePlan(strings.NewReader(cachePlanRaw))
+	plan, err := buildPlan(strings.NewReader(cachePlanRaw), nil)
 	if err != nil {
 		panic(err)
 	}
-
-	for _, query := range plan.Queries {
-		normalized := normalizer.NormalizeQuery(query.Query)
-		query.Query = normalized // make sure to use normalized query
-		queryMap[normalized] = *query
-		if query.Type != domains.CachePlanQueryType_SELECT || !query.Select.Cache {
-			continue
-		}
-
-		conditions := query.Select.Conditions
-		if isSingleUniqueCondition(conditions, query.Select.Table) {
-			caches[normalized] = cacheWithInfo{
-				query:      normalized,
-				info:       *query.Select,
-				cache:      sc.NewMust(replaceFn, 10*time.Minute, 10*time.Minute),
-				uniqueOnly: true,
-			}
-			continue
-		}
-		caches[query.Query] = cacheWithInfo{
-			query:      query.Query,
-			info:       *query.Select,
-			cache:      sc.NewMust(replaceFn, 10*time.Minute, 10*time.Minute),
-			uniqueOnly: false,
-		}
-
-		// TODO: if query is like "SELECT * FROM WHERE pk IN (?, ?, ...)", generate cache with query "SELECT * FROM table WHERE pk = ?"
-	}
-
-	for _, cache := range caches {
-		cacheByTable[cache.info.Table] = append(cacheByTable[cache.info.Table], cache)
-	}
+	currentPlan.Store(plan)
 }
 
 var _ driver.Driver = CacheDriver{}
 
+var primaryConnector atomic.Pointer[driver.Connector]
+
 type CacheDriver struct{}
 
 func (d CacheDriver) Open(dsn string) (driver.Conn, error) {
@@ -842,42 +1274,106 @@ func (d CacheDriver) Open(dsn string) (driver.Conn, error) {
 	if err != nil {
 		return nil, err
 	}
+	if primaryConnector.Load() == nil {
+		// the connector for the driver's own connections, which run queries without preparing them
+		flushCfg := cfg.Clone()
+		flushCfg.InterpolateParams = true
+		fc, err := mysql.NewConnector(flushCfg)
+		if err != nil {
+			return nil, err
+		}
+		if primaryConnector.CompareAndSwap(nil, &fc) {
+			preloadReplicas(loadPlan())
+		}
+	}
 	conn, err := c.Connect(context.Background())
 	if err != nil {
 		return nil, err
 	}
-	return &cacheConn{inner: conn}, nil
+	return &cacheConn{inner: conn, stmts: newStmtPool()}, nil
+}
+
+var _ driver.Connector = &cacheConnector{}
+
+// cacheConnector wraps the connections of another connector with the cache.
+type cacheConnector struct {
+	inner driver.Connector
+}
+
+// NewConnector returns a connector that wraps the connections opened by inner with the cache,
+// e.g. to run the driver on top of a fake database in tests.
+// The driver's own connections (write-behind, replicas and warm-up) are opened with inner from then on,
+// so its connections should run queries with arguments without preparing them.
+func NewConnector(inner driver.Connector) driver.Connector {
+	primaryConnector.Store(&inner)
+	resetWriteBehindConn()
+	invalidateReplicas()
+	return &cacheConnector{inner: inner}
+}
+
+func (c *cacheConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.inner.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &cacheConn{inner: conn, stmts: newStmtPool()}, nil
+}
+
+func (c *cacheConnector) Driver() driver.Driver {
+	return CacheDriver{}
 }
 
 var (
-	_ driver.Conn           = &cacheConn{}
-	_ driver.ConnBeginTx    = &cacheConn{}
-	_ driver.Pinger         = &cacheConn{}
-	_ driver.QueryerContext = &cacheConn{}
-	_ driver.ExecerContext  = &cacheConn{}
+	_ driver.Conn            = &cacheConn{}
+	_ driver.ConnBeginTx     = &cacheConn{}
+	_ driver.Pinger          = &cacheConn{}
+	_ driver.QueryerContext  = &cacheConn{}
+	_ driver.ExecerContext   = &cacheConn{}
+	_ driver.SessionResetter = &cacheConn{}
+	_ driver.Validator       = &cacheConn{}
 )
 
 type cacheConn struct {
 	inner   driver.Conn
 	tx      bool
 	cleanUp []func()
+	// pendingWrites are the write-behind inserts of the ongoing transaction
+	pendingWrites []pendingWrite
+	// replicaWrites are the replicated tables written in the ongoing transaction,
+	// and pendingReplica are the writes applied to their replicas on commit
+	replicaWrites  map[string]bool
+	pendingReplica []replicaWrite
+	// stmts holds the statements prepared by the driver itself (e.g. for IN expansion)
+	stmts *stmtPool
+	// readReplica is the connection to the read replica, opened on first use
+	readReplica driver.Conn
 }
 
 func (c *cacheConn) Prepare(rawQuery string) (driver.Stmt, error) {
 	normalizedQuery := normalizer.NormalizeQuery(rawQuery)
+	// statements prepared in a transaction may read its write-behind inserts
+	if err := c.flushPendingWritesFor(context.Background(), normalizedQuery); err != nil {
+		return nil, err
+	}
+
+	plan := loadPlan()
+	if q, err := parseReplicaQuery(rawQuery); err == nil && q.kind == replicaSelect && !q.forUpdate && plan.tables[q.table].Replicated {
+		return &replicaStatement{conn: c, rawQuery: rawQuery, query: q}, nil
+	}
 
-	queryInfo, ok := queryMap[normalizedQuery]
+	queryInfo, ok := plan.queryMap[normalizedQuery]
 	if !ok {
 		// unknown (insert, update, delete) query
 		if !strings.HasPrefix(strings.ToUpper(normalizedQuery), "SELECT") {
 			log.Println("unknown query:", normalizedQuery)
 			PurgeAllCaches()
+			return c.inner.Prepare(rawQuery)
 		}
-		return c.inner.Prepare(rawQuery)
+		return c.prepareRead(rawQuery)
 	}
 
 	if queryInfo.Type == domains.CachePlanQueryType_SELECT && !queryInfo.Select.Cache {
-		return c.inner.Prepare(rawQuery)
+		return c.prepareRead(rawQuery)
 	}
 
 	innerStmt, err := c.inner.Prepare(rawQuery)
@@ -894,9 +1390,38 @@ func (c *cacheConn) Prepare(rawQuery string) (driver.Stmt, error) {
 }
 
 func (c *cacheConn) Close() error {
+	if err := c.stmts.close(); err != nil {
+		log.Println("failed to close pooled statements:", err)
+	}
+	c.closeReplicaConn()
 	return c.inner.Close()
 }
 
+// ResetSession is called before the connection is reused from the pool.
+// Pending clean ups belong to the previous session, so they are dropped here.
+func (c *cacheConn) ResetSession(ctx context.Context) error {
+	c.tx = false
+	c.cleanUp = c.cleanUp[:0]
+	c.pendingWrites = c.pendingWrites[:0]
+	c.resetReplica()
+	if r, ok := c.readReplica.(driver.SessionResetter); ok {
+		if err := r.ResetSession(ctx); err != nil {
+			c.closeReplicaConn()
+		}
+	}
+	if r, ok := c.inner.(driver.SessionResetter); ok {
+		return r.ResetSession(ctx)
+	}
+	return nil
+}
+
+func (c *cacheConn) IsValid() bool {
+	if v, ok := c.inner.(driver.Validator); ok {
+		return v.IsValid()
+	}
+	return true
+}
+
 func (c *cacheConn) Begin() (driver.Tx, error) {
 	inner, err := c.BeginTx(context.Background(), driver.TxOptions{})
 	if err != nil {
@@ -913,14 +1438,14 @@ func (c *cacheConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.
 			return nil, err
 		}
 		c.tx = true
-		return &cacheTx{conn: c, inner: inner}, nil
+		return &cacheTx{conn: c, inner: inner, session: sessionOf(ctx)}, nil
 	}
 	inner, err := c.inner.Begin()
 	if err != nil {
 		return nil, err
 	}
 	c.tx = true
-	return &cacheTx{conn: c, inner: inner}, nil
+	return &cacheTx{conn: c, inner: inner, session: sessionOf(ctx)}, nil
 }
 
 func (c *cacheConn) Ping(ctx context.Context) error {
@@ -935,6 +1460,8 @@ var _ driver.Tx = &cacheTx{}
 type cacheTx struct {
 	conn  *cacheConn
 	inner driver.Tx
+	// session is the session the transaction was begun with (see WithSession)
+	session string
 }
 
 func (t *cacheTx) Commit() error {
@@ -945,22 +1472,95 @@ func (t *cacheTx) Commit() error {
 		}
 		t.conn.cleanUp = t.conn.cleanUp[:0]
 	}()
-	return t.inner.Commit()
+	if err := t.conn.commitWithReplicas(t.inner.Commit); err != nil {
+		t.conn.pendingWrites = t.conn.pendingWrites[:0]
+		return err
+	}
+	t.conn.commitPendingWrites()
+	markWrite(t.session)
+	return nil
 }
 
 func (t *cacheTx) Rollback() error {
 	t.conn.tx = false
 	// no need to clean up
 	t.conn.cleanUp = nil
+	t.conn.pendingWrites = t.conn.pendingWrites[:0]
+	t.conn.resetReplica()
 	return t.inner.Rollback()
 }
 
-var _ driver.Rows = &cacheRows{}
+var (
+	_ driver.Rows                           = &cacheRows{}
+	_ driver.RowsColumnTypeScanType         = &cacheRows{}
+	_ driver.RowsColumnTypeDatabaseTypeName = &cacheRows{}
+	_ driver.RowsColumnTypeNullable         = &cacheRows{}
+	_ driver.RowsColumnTypeLength           = &cacheRows{}
+	_ driver.RowsColumnTypePrecisionScale   = &cacheRows{}
+)
 
 type cacheRows struct {
-	cached  bool
-	columns []string
-	rows    sliceRows
+	cached      bool
+	columns     []string
+	columnTypes []columnType
+	rows        sliceRows
+	// size is the approximate number of bytes held by rows
+	size int64
+	// uncacheable is true if rows hold values that cannot be safely shared between queries
+	uncacheable bool
+	// fetchedAt is when the rows were read from the database
+	fetchedAt time.Time
+	// fromReplica is true if the rows were read from the read replica
+	fromReplica bool
+}
+
+// columnType is the column metadata captured from the backend, replayed on cache hits
+type columnType struct {
+	scanType         reflect.Type
+	databaseTypeName string
+	nullable         bool
+	hasNullable      bool
+	length           int64
+	hasLength        bool
+	precision        int64
+	scale            int64
+	hasPrecision     bool
+}
+
+var scanTypeAny = reflect.TypeOf(new(any)).Elem()
+
+func captureColumnTypes(inner driver.Rows, n int) []columnType {
+	types := make([]columnType, n)
+	for i := range types {
+		t := &types[i]
+		t.scanType = scanTypeAny
+		if r, ok := inner.(driver.RowsColumnTypeScanType); ok {
+			t.scanType = r.ColumnTypeScanType(i)
+		}
+		if r, ok := inner.(driver.RowsColumnTypeDatabaseTypeName); ok {
+			t.databaseTypeName = r.ColumnTypeDatabaseTypeName(i)
+		}
+		if r, ok := inner.(driver.RowsColumnTypeNullable); ok {
+			t.nullable, t.hasNullable = r.ColumnTypeNullable(i)
+		}
+		if r, ok := inner.(driver.RowsColumnTypeLength); ok {
+			t.length, t.hasLength = r.ColumnTypeLength(i)
+		}
+		if r, ok := inner.(driver.RowsColumnTypePrecisionScale); ok {
+			t.precision, t.scale, t.hasPrecision = r.ColumnTypePrecisionScale(i)
+		}
+	}
+	return types
+}
+
+// uncacheableError is returned from replaceFn when the rows must not be stored.
+// sc does not store a value that comes with an error, so the rows are handed to the caller through it.
+type uncacheableError struct {
+	rows *cacheRows
+}
+
+func (e *uncacheableError) Error() string {
+	return "rows contain values that cannot be cached"
 }
 
 func newCacheRows(inner driver.Rows) (*cacheRows, error) {
@@ -979,9 +1579,14 @@ func (r *cacheRows) clone() *cacheRows {
 		panic("cannot clone uncached rows")
 	}
 	return &cacheRows{
-		cached:  r.cached,
-		columns: r.columns,
-		rows:    r.rows.clone(),
+		cached:      r.cached,
+		columns:     r.columns,
+		columnTypes: r.columnTypes,
+		rows:        r.rows.clone(),
+		size:        r.size,
+		uncacheable: r.uncacheable,
+		fetchedAt:   r.fetchedAt,
+		fromReplica: r.fromReplica,
 	}
 }
 
@@ -1004,6 +1609,27 @@ func (r *cacheRows) Next(dest []driver.Value) error {
 	return r.rows.next(dest)
 }
 
+func (r *cacheRows) ColumnTypeScanType(index int) reflect.Type {
+	return r.columnTypes[index].scanType
+}
+
+func (r *cacheRows) ColumnTypeDatabaseTypeName(index int) string {
+	return r.columnTypes[index].databaseTypeName
+}
+
+func (r *cacheRows) ColumnTypeNullable(index int) (nullable, ok bool) {
+	return r.columnTypes[index].nullable, r.columnTypes[index].hasNullable
+}
+
+func (r *cacheRows) ColumnTypeLength(index int) (length int64, ok bool) {
+	return r.columnTypes[index].length, r.columnTypes[index].hasLength
+}
+
+func (r *cacheRows) ColumnTypePrecisionScale(index int) (precision, scale int64, ok bool) {
+	t := r.columnTypes[index]
+	return t.precision, t.scale, t.hasPrecision
+}
+
 func mergeCachedRows(rows []*cacheRows) *cacheRows {
 	if len(rows) == 0 {
 		return nil
@@ -1013,20 +1639,25 @@ func mergeCachedRows(rows []*cacheRows) *cacheRows {
 	}
 
 	mergedSlice := sliceRows{}
+	var size int64
 	for _, r := range rows {
 		mergedSlice.concat(r.rows)
+		size += r.size
 	}
 
 	return &cacheRows{
-		cached:  true,
-		columns: rows[0].columns,
-		rows:    mergedSlice,
+		cached:      true,
+		columns:     rows[0].columns,
+		columnTypes: rows[0].columnTypes,
+		rows:        mergedSlice,
+		size:        size,
 	}
 }
 
 func (r *cacheRows) cacheInnerRows(inner driver.Rows) error {
 	columns := inner.Columns()
 	r.columns = columns
+	r.columnTypes = captureColumnTypes(inner, len(columns))
 	dest := make([]driver.Value, len(columns))
 
 	for {
@@ -1039,19 +1670,15 @@ func (r *cacheRows) cacheInnerRows(inner driver.Rows) error {
 
 		cachedRow := make(row, len(dest))
 		for i := 0; i < len(dest); i++ {
-			switch v := dest[i].(type) {
-			case int64, uint64, float64, string, bool, time.Time, nil: // no need to copy
-				cachedRow[i] = v
-			case []byte: // copy to prevent mutation
-				data := make([]byte, len(v))
-				copy(data, v)
-				cachedRow[i] = data
-			default:
-				// TODO: handle other types
-				// Should we mark this row as uncacheable?
+			v, ok := copyValue(dest[i])
+			if !ok {
+				// keep the value for this query, but never share it with others
+				r.uncacheable = true
 			}
+			cachedRow[i] = v
 		}
 		r.rows.append(cachedRow)
+		r.size += rowSize(cachedRow)
 	}
 
 	r.cached = true
@@ -1059,6 +1686,37 @@ func (r *cacheRows) cacheInnerRows(inner driver.Rows) error {
 	return nil
 }
 
+// copyValue returns a copy of v that is not affected by later mutation of the backend's buffers.
+// ok is false if v is of a type that cannot be copied safely.
+func copyValue(v driver.Value) (driver.Value, bool) {
+	switch v := v.(type) {
+	case int64, uint64, float64, string, bool, time.Time, nil: // no need to copy
+		return v, true
+	case []byte: // copy to prevent mutation
+		data := make([]byte, len(v))
+		copy(data, v)
+		return data, true
+	}
+
+	rv := reflect.ValueOf(v)
+	switch rv.Kind() {
+	case reflect.Bool, reflect.String,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64,
+		reflect.Float32, reflect.Float64, reflect.Complex64, reflect.Complex128:
+		// immutable values such as float32 or named integer types
+		return v, true
+	case reflect.Slice:
+		if rv.Type().Elem().Kind() == reflect.Uint8 {
+			// named byte slices such as json.RawMessage
+			data := reflect.MakeSlice(rv.Type(), rv.Len(), rv.Len())
+			reflect.Copy(data, rv)
+			return data.Interface(), true
+		}
+	}
+	return v, false
+}
+
 type row = []driver.Value
 
 type sliceRows struct {
@@ -0,0 +1,417 @@
+package cache
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"fmt"
+	"math/rand/v2"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+var fakeSchema = map[string][]string{
+	"users":                      {"id", "name", "display_name", "password", "description"},
+	"themes":                     {"id", "user_id", "dark_mode"},
+	"tags":                       {"id", "name"},
+	"livestreams":                {"id", "user_id", "title", "description", "playlist_url", "thumbnail_url", "start_at", "end_at"},
+	"livestream_tags":            {"id", "livestream_id", "tag_id"},
+	"livestream_viewers_history": {"id", "user_id", "livestream_id", "created_at"},
+	"livecomments":               {"id", "user_id", "livestream_id", "comment", "tip", "created_at"},
+	"ng_words":                   {"id", "user_id", "livestream_id", "word", "created_at"},
+	"reservation_slots":          {"id", "slot", "start_at", "end_at"},
+}
+
+// testPlanQueries are added to the plan so that "tag_id IN (?, ...)" is decomposed into cached lookups
+const testPlanQueries = `
+  - query: SELECT * FROM livestream_tags WHERE tag_id = ?;
+    type: select
+    table: livestream_tags
+    cache: true
+    targets:
+      - livestream_id
+      - tag_id
+      - id
+    conditions:
+      - column: tag_id
+        operator: eq
+        placeholder:
+          index: 0
+`
+
+// setupFakeDB returns a database through the driver and a direct connection to the same fake database.
+func setupFakeDB(t *testing.T) (cached, direct *sql.DB) {
+	t.Helper()
+	if err := ReloadPlan(strings.NewReader(cachePlanRaw + testPlanQueries)); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		if err := ReloadPlan(strings.NewReader(cachePlanRaw)); err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	db := newFakeDB(fakeSchema)
+	cached = sql.OpenDB(NewConnector(&fakeConnector{db: db}))
+	direct = sql.OpenDB(&fakeConnector{db: db})
+	t.Cleanup(func() {
+		cached.Close()
+		direct.Close()
+	})
+	Initialize()
+
+	for _, q := range []string{
+		"INSERT INTO users (name, display_name, password, description) VALUES ('alice', 'Alice', 'x', ''), ('bob', 'Bob', 'x', ''), ('carol', 'Carol', 'x', '')",
+		"INSERT INTO tags (name) VALUES ('a'), ('b'), ('c'), ('d')",
+		"INSERT INTO reservation_slots (slot, start_at, end_at) VALUES (5, 0, 10), (5, 10, 20), (5, 20, 30), (5, 30, 40)",
+	} {
+		if _, err := direct.Exec(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return cached, direct
+}
+
+// fakeOp is a statement run by the property test; reads are compared with the fake's own results
+type fakeOp struct {
+	query string
+	args  []any
+	read  bool
+	// prepared runs the read through a prepared statement
+	prepared bool
+	// orderBy compares rows by the ORDER BY of a query whose ties may come in any order
+	orderBy func(a, b []any) int
+}
+
+type fakeOpGenerator struct {
+	r   *rand.Rand
+	now int64
+}
+
+func (g *fakeOpGenerator) id(n int) int64 {
+	return g.r.Int64N(int64(n)) + 1
+}
+
+func (g *fakeOpGenerator) next() fakeOp {
+	g.now++
+	switch g.r.IntN(24) {
+	case 0:
+		return fakeOp{query: "SELECT * FROM users WHERE id = ?", args: []any{g.id(6)}, read: true}
+	case 1:
+		names := []string{"alice", "bob", "carol", fmt.Sprintf("user%d", g.r.Int64N(g.now))}
+		return fakeOp{query: "SELECT * FROM users WHERE name = ?", args: []any{names[g.r.IntN(len(names))]}, read: true}
+	case 2:
+		return fakeOp{query: "INSERT INTO users (name, display_name, description, password) VALUES (?, ?, ?, ?)", args: []any{fmt.Sprintf("user%d", g.now), "User", "", "x"}}
+	case 3:
+		return fakeOp{query: "SELECT * FROM themes WHERE user_id = ?", args: []any{g.id(4)}, read: true}
+	case 4:
+		return fakeOp{query: "INSERT INTO themes (user_id, dark_mode) VALUES (?, ?)", args: []any{g.id(4), g.r.IntN(2) == 0}}
+	case 5:
+		return fakeOp{query: "SELECT * FROM tags", read: true}
+	case 6:
+		return fakeOp{query: "SELECT * FROM livestreams WHERE id = ?", args: []any{g.id(8)}, read: true}
+	case 7:
+		return fakeOp{query: "SELECT * FROM livestreams WHERE user_id = ?", args: []any{g.id(3)}, read: true}
+	case 8:
+		return fakeOp{query: "SELECT * FROM livestreams ORDER BY id DESC LIMIT ?", args: []any{g.id(5)}, read: true}
+	case 9:
+		return fakeOp{query: "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (?, ?, ?, ?, ?, ?, ?)", args: []any{g.id(3), "title", "", "", "", g.now, g.now + 1}}
+	case 10:
+		// not in the plan, so every cache is purged
+		return fakeOp{query: "UPDATE livestreams SET title = ? WHERE id = ?", args: []any{fmt.Sprintf("title%d", g.now), g.id(8)}}
+	case 11:
+		return fakeOp{query: "SELECT * FROM livestream_tags WHERE livestream_id = ?", args: []any{g.id(8)}, read: true}
+	case 12:
+		return fakeOp{
+			query: "SELECT * FROM livestream_tags WHERE tag_id IN (?, ?) ORDER BY livestream_id DESC",
+			args:  []any{g.id(4), g.id(4)},
+			read:  true,
+			orderBy: func(a, b []any) int {
+				return cmp.Compare(b[1].(int64), a[1].(int64))
+			},
+		}
+	case 13:
+		return fakeOp{query: "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (?, ?)", args: []any{g.id(8), g.id(4)}}
+	case 14:
+		return fakeOp{query: "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC", args: []any{g.id(8)}, read: true}
+	case 15:
+		return fakeOp{query: "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC LIMIT ?", args: []any{g.id(8), g.id(3)}, read: true}
+	case 16:
+		return fakeOp{query: "SELECT * FROM livecomments WHERE id = ?", args: []any{g.id(10)}, read: true}
+	case 17:
+		return fakeOp{query: "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (?, ?, ?, ?, ?)", args: []any{g.id(3), g.id(8), "hi", g.r.Int64N(100), g.now}}
+	case 18:
+		return fakeOp{query: "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", args: []any{g.id(8)}, read: true}
+	case 19:
+		return fakeOp{query: "INSERT INTO livestream_viewers_history (user_id, livestream_id, created_at) VALUES (?, ?, ?)", args: []any{g.id(3), g.id(8), g.now}}
+	case 20:
+		return fakeOp{query: "DELETE FROM livestream_viewers_history WHERE user_id = ? AND livestream_id = ?", args: []any{g.id(3), g.id(8)}}
+	case 21:
+		return fakeOp{query: "SELECT * FROM ng_words WHERE livestream_id = ?", args: []any{g.id(8)}, read: true}
+	case 22:
+		return fakeOp{query: "INSERT INTO ng_words (user_id, livestream_id, word, created_at) VALUES (?, ?, ?, ?)", args: []any{g.id(3), g.id(8), "ng", g.now}}
+	default:
+		start := g.r.Int64N(4) * 10
+		if g.r.IntN(2) == 0 {
+			return fakeOp{query: "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", args: []any{start, start + 10}, read: true}
+		}
+		return fakeOp{query: "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", args: []any{start, start + 10}}
+	}
+}
+
+type queryer interface {
+	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
+	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
+	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
+}
+
+func readAll(ctx context.Context, db queryer, op fakeOp) ([][]any, error) {
+	var rows *sql.Rows
+	var err error
+	if op.prepared {
+		var stmt *sql.Stmt
+		if stmt, err = db.PrepareContext(ctx, op.query); err != nil {
+			return nil, err
+		}
+		defer stmt.Close()
+		rows, err = stmt.QueryContext(ctx, op.args...)
+	} else {
+		rows, err = db.QueryContext(ctx, op.query, op.args...)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	columns, err := rows.Columns()
+	if err != nil {
+		return nil, err
+	}
+	var res [][]any
+	for rows.Next() {
+		values := make([]any, len(columns))
+		dest := make([]any, len(columns))
+		for i := range values {
+			dest[i] = &values[i]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, v := range values {
+			values[i] = comparableValue(v)
+		}
+		res = append(res, values)
+	}
+	return res, rows.Err()
+}
+
+// withID makes an insert set the id that the driver returned for it,
+// so that the fake assigns the same id as a write-behind insert of the driver.
+func withID(op fakeOp, id int64) fakeOp {
+	op.query = strings.Replace(op.query, " (", " (id, ", 1)
+	op.query = strings.Replace(op.query, "VALUES (", "VALUES (?, ", 1)
+	op.args = append([]any{id}, op.args...)
+	return op
+}
+
+// TestCacheMatchesDatabase runs random sequences of the plan's statements, some of them in transactions,
+// and checks that every read through the driver returns what the database holds.
+// Reads in a transaction are compared with a transaction on the fake that runs the same writes.
+func TestCacheMatchesDatabase(t *testing.T) {
+	for seed := range uint64(20) {
+		t.Run(fmt.Sprintf("seed=%d", seed), func(t *testing.T) {
+			cached, direct := setupFakeDB(t)
+			ctx := context.Background()
+			g := &fakeOpGenerator{r: rand.New(rand.NewPCG(seed, seed))}
+
+			var history []string
+			compare := func(op fakeOp, step int, got, want [][]any) {
+				t.Helper()
+				if op.orderBy != nil {
+					if !slices.IsSortedFunc(got, op.orderBy) {
+						t.Fatalf("step %d: %s %v: not ordered: %v", step, op.query, op.args, got)
+					}
+					// compare the ties regardless of their order
+					byRow := func(a, b []any) int {
+						return cmp.Or(op.orderBy(a, b), strings.Compare(fmt.Sprint(a), fmt.Sprint(b)))
+					}
+					slices.SortFunc(got, byRow)
+					slices.SortFunc(want, byRow)
+				}
+				if !reflect.DeepEqual(got, want) {
+					t.Fatalf("step %d: %s %v\ngot  %v\nwant %v\nhistory:\n%s", step, op.query, op.args, got, want, strings.Join(history, "\n"))
+				}
+			}
+			check := func(db queryer, op fakeOp, step int) {
+				t.Helper()
+				got, err := readAll(ctx, db, op)
+				if err != nil {
+					t.Fatalf("step %d: %s: %v", step, op.query, err)
+				}
+				// reads on the fake see the queued inserts only once they are flushed
+				if err := FlushWriteBehind(ctx); err != nil {
+					t.Fatal(err)
+				}
+				want, err := readAll(ctx, direct, op)
+				if err != nil {
+					t.Fatalf("step %d: %s: %v", step, op.query, err)
+				}
+				compare(op, step, got, want)
+			}
+			next := func() fakeOp {
+				op := g.next()
+				op.prepared = op.read && g.r.IntN(4) == 0
+				return op
+			}
+
+			for step := range 300 {
+				if g.r.IntN(10) > 0 {
+					op := next()
+					history = append(history, fmt.Sprintf("%s %v%s", op.query, op.args, preparedMark(op)))
+					if op.read {
+						check(cached, op, step)
+					} else if _, err := cached.ExecContext(ctx, op.query, op.args...); err != nil {
+						t.Fatalf("step %d: %s: %v", step, op.query, err)
+					}
+					continue
+				}
+
+				// the direct transaction must not see inserts queued before it
+				if err := FlushWriteBehind(ctx); err != nil {
+					t.Fatal(err)
+				}
+				tx, err := cached.BeginTx(ctx, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				// directTx runs the same statements and is always rolled back, so that they are applied only once
+				directTx, err := direct.BeginTx(ctx, nil)
+				if err != nil {
+					t.Fatal(err)
+				}
+				history = append(history, "BEGIN")
+				for range g.r.IntN(4) + 1 {
+					op := next()
+					history = append(history, fmt.Sprintf("  %s %v%s", op.query, op.args, preparedMark(op)))
+					if op.read {
+						got, err := readAll(ctx, tx, op)
+						if err != nil {
+							t.Fatalf("step %d: %s: %v", step, op.query, err)
+						}
+						want, err := readAll(ctx, directTx, op)
+						if err != nil {
+							t.Fatalf("step %d: %s: %v", step, op.query, err)
+						}
+						compare(op, step, got, want)
+						continue
+					}
+					res, err := tx.ExecContext(ctx, op.query, op.args...)
+					if err != nil {
+						t.Fatalf("step %d: %s: %v", step, op.query, err)
+					}
+					if strings.HasPrefix(op.query, "INSERT") {
+						id, err := res.LastInsertId()
+						if err != nil {
+							t.Fatal(err)
+						}
+						op = withID(op, id)
+					}
+					if _, err := directTx.ExecContext(ctx, op.query, op.args...); err != nil {
+						t.Fatalf("step %d: %s: %v", step, op.query, err)
+					}
+				}
+				if err := directTx.Rollback(); err != nil {
+					t.Fatal(err)
+				}
+				if g.r.IntN(3) == 0 {
+					history = append(history, "ROLLBACK")
+					err = tx.Rollback()
+				} else {
+					history = append(history, "COMMIT")
+					err = tx.Commit()
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func preparedMark(op fakeOp) string {
+	if op.prepared {
+		return " (prepared)"
+	}
+	return ""
+}
+
+// A primary key lookup that finds nothing must not be cached: inserts do not purge such caches.
+func TestUniqueLookupSeesLaterInsert(t *testing.T) {
+	cached, _ := setupFakeDB(t)
+	ctx := context.Background()
+	lookup := fakeOp{query: "SELECT * FROM livestreams WHERE id = ?", args: []any{int64(1)}, read: true}
+
+	got, err := readAll(ctx, cached, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatalf("got %v before the insert", got)
+	}
+	if _, err := cached.ExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES (?, ?, ?, ?, ?, ?, ?)", 1, "title", "", "", "", 0, 1); err != nil {
+		t.Fatal(err)
+	}
+	got, err = readAll(ctx, cached, lookup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %v after the insert, want the inserted row", got)
+	}
+}
+
+// A prepared IN query served from the per-value caches returns each row once and in the requested order.
+func TestPreparedInQueryDedupsAndSorts(t *testing.T) {
+	cached, direct := setupFakeDB(t)
+	ctx := context.Background()
+	for _, q := range []string{
+		"INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (1, 1), (3, 1), (2, 2)",
+	} {
+		if _, err := direct.ExecContext(ctx, q); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	stmt, err := cached.PrepareContext(ctx, "SELECT * FROM livestream_tags WHERE tag_id IN (?, ?) ORDER BY livestream_id DESC")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer stmt.Close()
+	for _, tc := range []struct {
+		args []any
+		want []int64
+	}{
+		{args: []any{int64(1), int64(1)}, want: []int64{3, 1}},
+		{args: []any{int64(1), int64(2)}, want: []int64{3, 2, 1}},
+	} {
+		rows, err := stmt.QueryContext(ctx, tc.args...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []int64
+		for rows.Next() {
+			var id, livestreamID, tagID int64
+			if err := rows.Scan(&id, &livestreamID, &tagID); err != nil {
+				t.Fatal(err)
+			}
+			ids = append(ids, livestreamID)
+		}
+		if err := rows.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if !slices.Equal(ids, tc.want) {
+			t.Fatalf("%v: got livestream ids %v, want %v", tc.args, ids, tc.want)
+		}
+	}
+}
@@ -0,0 +1,432 @@
+package cache
+
+import (
+	"cmp"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/traP-jp/isuc/domains"
+)
+
+// fakeDB is an in-memory database for testing the driver without MySQL.
+// It runs the single-table statements of replicaQuery (which covers the plan's statement shapes
+// except joins), plus the MAX(id) query of write-behind.
+// Transactions see the committed rows as of each statement plus their own writes (READ COMMITTED),
+// and their writes are replayed onto the committed rows on commit.
+type fakeDB struct {
+	mu     sync.Mutex
+	tables map[string]*fakeTable
+}
+
+type fakeTable struct {
+	name    string
+	columns []string
+	index   map[string]int
+	// rows are sorted by id if the table has one, and are replaced instead of mutated
+	rows   []row
+	nextID int64
+}
+
+// newFakeDB creates empty tables with the given columns in order.
+func newFakeDB(schema map[string][]string) *fakeDB {
+	db := &fakeDB{tables: make(map[string]*fakeTable, len(schema))}
+	for name, columns := range schema {
+		t := &fakeTable{name: name, columns: columns, index: make(map[string]int, len(columns)), nextID: 1}
+		for i, column := range columns {
+			t.index[column] = i
+		}
+		db.tables[name] = t
+	}
+	return db
+}
+
+func cloneFakeTables(tables map[string]*fakeTable) map[string]*fakeTable {
+	cloned := make(map[string]*fakeTable, len(tables))
+	for name, t := range tables {
+		copied := *t
+		copied.rows = slices.Clone(t.rows)
+		cloned[name] = &copied
+	}
+	return cloned
+}
+
+var fakeMaxIDPattern = regexp.MustCompile(`^SELECT IFNULL\(MAX\((\w+)\), 0\) FROM (\w+)$`)
+
+// runFakeQuery runs the query on tables.
+func runFakeQuery(tables map[string]*fakeTable, query string, args []driver.Value) (*fakeRows, driver.Result, error) {
+	if m := fakeMaxIDPattern.FindStringSubmatch(query); m != nil {
+		t, ok := tables[m[2]]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown table %s", m[2])
+		}
+		var maxID int64
+		for _, r := range t.rows {
+			maxID = max(maxID, r[t.index[m[1]]].(int64))
+		}
+		return &fakeRows{columns: []string{"max"}, scanTypes: []reflect.Type{reflect.TypeOf(int64(0))}, rows: []row{{maxID}}}, nil, nil
+	}
+
+	q, err := newReplicaParser(query).parse()
+	if err != nil {
+		return nil, nil, fmt.Errorf("fake database does not support %q: %w", query, err)
+	}
+	if q.placeholders != len(args) {
+		return nil, nil, fmt.Errorf("expected %d arguments, got %d", q.placeholders, len(args))
+	}
+	t, ok := tables[q.table]
+	if !ok {
+		return nil, nil, fmt.Errorf("unknown table %s", q.table)
+	}
+	for _, column := range q.referencedColumns() {
+		if _, ok := t.index[column]; !ok {
+			return nil, nil, fmt.Errorf("unknown column %s.%s", q.table, column)
+		}
+	}
+	switch q.kind {
+	case replicaSelect:
+		return t.query(q, args), nil, nil
+	case replicaInsert:
+		res, err := t.insert(q, args)
+		return nil, res, err
+	case replicaUpdate:
+		res, err := t.update(q, args)
+		return nil, res, err
+	default:
+		var deleted int64
+		t.rows = slices.DeleteFunc(t.rows, func(r row) bool {
+			if q.match(r, t.index, args) {
+				deleted++
+				return true
+			}
+			return false
+		})
+		return nil, fakeResult{rowsAffected: deleted}, nil
+	}
+}
+
+func (q *replicaQuery) referencedColumns() []string {
+	columns := slices.Concat(q.targets, q.columns)
+	for _, set := range q.sets {
+		columns = append(columns, set.column)
+	}
+	for _, cond := range q.conditions {
+		columns = append(columns, cond.column)
+	}
+	for _, order := range q.orders {
+		columns = append(columns, order.column)
+	}
+	return columns
+}
+
+func (t *fakeTable) query(q *replicaQuery, args []driver.Value) *fakeRows {
+	var matched []row
+	for _, r := range t.rows {
+		if q.match(r, t.index, args) {
+			matched = append(matched, r)
+		}
+	}
+	slices.SortStableFunc(matched, func(a, b row) int {
+		for _, order := range q.orders {
+			i := t.index[order.column]
+			c, _ := compareValues(a[i], b[i])
+			if order.desc {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
+	if q.offset != nil {
+		offset := comparableValue(q.offset.value(args)).(int64)
+		matched = matched[min(int(offset), len(matched)):]
+	}
+	if q.limit != nil {
+		limit := comparableValue(q.limit.value(args)).(int64)
+		matched = matched[:min(int(limit), len(matched))]
+	}
+
+	if q.count {
+		return &fakeRows{columns: []string{"COUNT(*)"}, scanTypes: []reflect.Type{reflect.TypeOf(int64(0))}, rows: []row{{int64(len(matched))}}}
+	}
+	targets := q.targets
+	if targets == nil {
+		targets = t.columns
+	}
+	res := &fakeRows{columns: targets, scanTypes: make([]reflect.Type, len(targets))}
+	for i, target := range targets {
+		res.scanTypes[i] = t.scanType(target)
+	}
+	for _, r := range matched {
+		projected := make(row, len(targets))
+		for i, target := range targets {
+			projected[i] = r[t.index[target]]
+		}
+		res.rows = append(res.rows, projected)
+	}
+	return res
+}
+
+// scanType is the type the mysql driver reports for the column of the app's schema.
+func (t *fakeTable) scanType(column string) reflect.Type {
+	switch tableSchema[t.name].Columns[column].DataType {
+	case domains.TableSchemaDataType_INT, domains.TableSchemaDataType_INT64:
+		return reflect.TypeOf(int64(0))
+	case domains.TableSchemaDataType_DATETIME:
+		return reflect.TypeOf(time.Time{})
+	}
+	return reflect.TypeOf([]byte(nil))
+}
+
+func (t *fakeTable) insert(q *replicaQuery, args []driver.Value) (driver.Result, error) {
+	idIdx, hasID := t.index["id"]
+	var lastInsertID int64
+	for _, values := range q.values {
+		r := make(row, len(t.columns))
+		for i, column := range q.columns {
+			r[t.index[column]] = comparableValue(values[i].value(args))
+		}
+		if hasID {
+			if r[idIdx] == nil {
+				r[idIdx] = t.nextID
+				if lastInsertID == 0 {
+					lastInsertID = t.nextID
+				}
+			}
+			id, ok := r[idIdx].(int64)
+			if !ok {
+				return nil, fmt.Errorf("invalid id %v", r[idIdx])
+			}
+			if slices.ContainsFunc(t.rows, func(r row) bool { return r[idIdx] == id }) {
+				return nil, fmt.Errorf("duplicate entry %d for key %s.id", id, t.name)
+			}
+			t.nextID = max(t.nextID, id+1)
+		}
+		t.rows = append(t.rows, r)
+	}
+	if hasID {
+		slices.SortStableFunc(t.rows, func(a, b row) int { return cmp.Compare(a[idIdx].(int64), b[idIdx].(int64)) })
+	}
+	return fakeResult{lastInsertID: lastInsertID, rowsAffected: int64(len(q.values))}, nil
+}
+
+func (t *fakeTable) update(q *replicaQuery, args []driver.Value) (driver.Result, error) {
+	var updated int64
+	for i, r := range t.rows {
+		if !q.match(r, t.index, args) {
+			continue
+		}
+		r = slices.Clone(r)
+		for _, set := range q.sets {
+			v := comparableValue(set.value.value(args))
+			if set.delta != 0 {
+				cur, ok1 := r[t.index[set.column]].(int64)
+				d, ok2 := v.(int64)
+				if !ok1 || !ok2 {
+					return nil, fmt.Errorf("cannot compute %s", set.column)
+				}
+				v = cur + int64(set.delta)*d
+			}
+			r[t.index[set.column]] = v
+		}
+		t.rows[i] = r
+		updated++
+	}
+	return fakeResult{rowsAffected: updated}, nil
+}
+
+type fakeResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (r fakeResult) LastInsertId() (int64, error) { return r.lastInsertID, nil }
+func (r fakeResult) RowsAffected() (int64, error) { return r.rowsAffected, nil }
+
+var (
+	_ driver.Rows                   = &fakeRows{}
+	_ driver.RowsColumnTypeScanType = &fakeRows{}
+)
+
+// fakeRows returns strings as []byte like the text protocol of the mysql driver
+type fakeRows struct {
+	columns   []string
+	scanTypes []reflect.Type
+	rows      []row
+	pos       int
+}
+
+func (r *fakeRows) Columns() []string { return r.columns }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.pos >= len(r.rows) {
+		return io.EOF
+	}
+	for i, v := range r.rows[r.pos] {
+		if s, ok := v.(string); ok {
+			dest[i] = []byte(s)
+		} else {
+			dest[i] = v
+		}
+	}
+	r.pos++
+	return nil
+}
+
+func (r *fakeRows) ColumnTypeScanType(index int) reflect.Type { return r.scanTypes[index] }
+
+var _ driver.Connector = &fakeConnector{}
+
+type fakeConnector struct {
+	db *fakeDB
+}
+
+func (c *fakeConnector) Connect(context.Context) (driver.Conn, error) {
+	return &fakeConn{db: c.db}, nil
+}
+
+func (c *fakeConnector) Driver() driver.Driver { return fakeDriver{} }
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(string) (driver.Conn, error) {
+	return nil, errors.New("fake database can only be opened with its connector")
+}
+
+var (
+	_ driver.Conn           = &fakeConn{}
+	_ driver.ConnBeginTx    = &fakeConn{}
+	_ driver.QueryerContext = &fakeConn{}
+	_ driver.ExecerContext  = &fakeConn{}
+)
+
+type fakeConn struct {
+	db *fakeDB
+	tx *fakeTx
+}
+
+// fakeStatement is a write of a transaction
+type fakeStatement struct {
+	query string
+	args  []driver.Value
+}
+
+func (c *fakeConn) run(query string, args []driver.NamedValue) (*fakeRows, driver.Result, error) {
+	values := namedToValue(args)
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+	if c.tx == nil {
+		return runFakeQuery(c.db.tables, query, values)
+	}
+
+	tables := cloneFakeTables(c.db.tables)
+	for _, w := range c.tx.writes {
+		if _, _, err := runFakeQuery(tables, w.query, w.args); err != nil {
+			return nil, nil, err
+		}
+	}
+	rows, res, err := runFakeQuery(tables, query, values)
+	if err == nil && rows == nil {
+		c.tx.writes = append(c.tx.writes, fakeStatement{query: query, args: values})
+	}
+	return rows, res, err
+}
+
+func (c *fakeConn) QueryContext(_ context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, _, err := c.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if rows == nil {
+		return nil, fmt.Errorf("%q does not return rows", query)
+	}
+	return rows, nil
+}
+
+func (c *fakeConn) ExecContext(_ context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	_, res, err := c.run(query, args)
+	if err != nil {
+		return nil, err
+	}
+	if res == nil {
+		return fakeResult{}, nil
+	}
+	return res, nil
+}
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) {
+	return &fakeStmt{conn: c, query: query}, nil
+}
+
+func (c *fakeConn) Close() error { return nil }
+
+func (c *fakeConn) Begin() (driver.Tx, error) {
+	return c.BeginTx(context.Background(), driver.TxOptions{})
+}
+
+func (c *fakeConn) BeginTx(context.Context, driver.TxOptions) (driver.Tx, error) {
+	if c.tx != nil {
+		return nil, errors.New("transaction already started")
+	}
+	c.tx = &fakeTx{conn: c}
+	return c.tx, nil
+}
+
+type fakeTx struct {
+	conn   *fakeConn
+	writes []fakeStatement
+}
+
+func (t *fakeTx) Commit() error {
+	db := t.conn.db
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	t.conn.tx = nil
+	tables := cloneFakeTables(db.tables)
+	for _, w := range t.writes {
+		if _, _, err := runFakeQuery(tables, w.query, w.args); err != nil {
+			return err
+		}
+	}
+	db.tables = tables
+	return nil
+}
+
+func (t *fakeTx) Rollback() error {
+	t.conn.tx = nil
+	return nil
+}
+
+type fakeStmt struct {
+	conn  *fakeConn
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	return s.conn.ExecContext(context.Background(), s.query, valueToNamedValue(args))
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	return s.conn.QueryContext(context.Background(), s.query, valueToNamedValue(args))
+}
+
+func (s *fakeStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	return s.conn.ExecContext(ctx, s.query, args)
+}
+
+func (s *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	return s.conn.QueryContext(ctx, s.query, args)
+}
@@ -0,0 +1,270 @@
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+
+	"github.com/traP-jp/isuc/normalizer"
+)
+
+const (
+	// rough overhead of a cached row: slice header + interface headers
+	rowOverhead   = int64(unsafe.Sizeof(row{}))
+	valueOverhead = int64(unsafe.Sizeof(any(nil)))
+	// eviction frees memory down to this ratio of the budget so that it does not run on every fill
+	evictionLowWatermark = 0.9
+)
+
+var (
+	totalBytes atomic.Int64
+
+	totalLimit    atomic.Int64
+	perQueryLimit atomic.Int64
+	queryLimits   sync.Map // normalized query -> int64
+)
+
+// SetMemoryLimit sets the byte budget of all cached rows and the default budget of each query.
+// A limit <= 0 means unlimited.
+func SetMemoryLimit(total, perQuery int64) {
+	totalLimit.Store(total)
+	perQueryLimit.Store(perQuery)
+}
+
+// SetQueryMemoryLimit overrides the byte budget of the given query.
+func SetQueryMemoryLimit(query string, limit int64) {
+	queryLimits.Store(cacheName(normalizer.NormalizeQuery(query)), limit)
+}
+
+func queryLimit(query string) int64 {
+	if limit, ok := queryLimits.Load(query); ok {
+		return limit.(int64)
+	}
+	return perQueryLimit.Load()
+}
+
+// memoryUsage tracks the size of every entry in a cache and keeps them in least recently used order.
+// sc does not expose its entries, so the driver keeps its own index to decide what to evict.
+type memoryUsage struct {
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// lru holds *memoryEntry, the most recently used at the front
+	lru   *list.List
+	bytes int64
+}
+
+type memoryEntry struct {
+	key  string
+	size int64
+	// rows tells a new fill from a hit on the same key
+	rows       *cacheRows
+	filledAt   time.Time
+	lastAccess time.Time
+}
+
+func newMemoryUsage() *memoryUsage {
+	return &memoryUsage{entries: make(map[string]*list.Element), lru: list.New()}
+}
+
+func (m *memoryUsage) usage() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bytes
+}
+
+// keys returns the keys of the entries in the cache
+func (m *memoryUsage) keys() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := make([]string, 0, len(m.entries))
+	for key := range m.entries {
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// touch records an access to the rows cached at key and returns the bytes of the cache.
+func (m *memoryUsage) touch(key string, rows *cacheRows, now time.Time) int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem, ok := m.entries[key]
+	if !ok {
+		elem = m.lru.PushFront(&memoryEntry{key: key})
+		m.entries[key] = elem
+	} else {
+		m.lru.MoveToFront(elem)
+	}
+	entry := elem.Value.(*memoryEntry)
+	if entry.rows != rows {
+		m.add(rows.size - entry.size)
+		entry.size = rows.size
+		entry.rows = rows
+		entry.filledAt = now
+	}
+	entry.lastAccess = now
+	return m.bytes
+}
+
+func (m *memoryUsage) remove(key string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if elem, ok := m.entries[key]; ok {
+		m.removeElement(elem)
+	}
+}
+
+func (m *memoryUsage) reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.add(-m.bytes)
+	clear(m.entries)
+	m.lru.Init()
+}
+
+// coldest returns the last access of the least recently used entry.
+func (m *memoryUsage) coldest() (time.Time, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	elem := m.lru.Back()
+	if elem == nil {
+		return time.Time{}, false
+	}
+	return elem.Value.(*memoryEntry).lastAccess, true
+}
+
+// popColdest removes the least recently used entries until need bytes are freed,
+// stopping at entries accessed after until (if not zero). At least one entry is removed.
+// It returns the removed keys, which the caller must forget in sc.
+func (m *memoryUsage) popColdest(need int64, until time.Time) []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var keys []string
+	for elem := m.lru.Back(); elem != nil; elem = m.lru.Back() {
+		entry := elem.Value.(*memoryEntry)
+		if len(keys) > 0 && (need <= 0 || (!until.IsZero() && entry.lastAccess.After(until))) {
+			break
+		}
+		need -= entry.size
+		keys = append(keys, entry.key)
+		m.removeElement(elem)
+	}
+	return keys
+}
+
+// pruneFilledBefore removes the entries filled before deadline, which sc has already expired.
+func (m *memoryUsage) pruneFilledBefore(deadline time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, elem := range m.entries {
+		if elem.Value.(*memoryEntry).filledAt.Before(deadline) {
+			m.removeElement(elem)
+		}
+	}
+}
+
+// removeElement must be called with mu held
+func (m *memoryUsage) removeElement(elem *list.Element) {
+	entry := elem.Value.(*memoryEntry)
+	m.add(-entry.size)
+	delete(m.entries, entry.key)
+	m.lru.Remove(elem)
+}
+
+// add must be called with mu held
+func (m *memoryUsage) add(delta int64) {
+	m.bytes += delta
+	totalBytes.Add(delta)
+}
+
+var (
+	evictorOnce sync.Once
+	// evictSignal wakes the evictor when the global budget is exceeded
+	evictSignal = make(chan struct{}, 1)
+)
+
+// enforceMemoryLimits evicts the least recently used entries of cache when it exceeds its own budget.
+// When the global budget is exceeded, the evictor goroutine is woken to evict across all caches
+// so that the read path does not scan them.
+func enforceMemoryLimits(cache cacheWithInfo, cacheBytes int64) {
+	if limit := queryLimit(cache.query); limit > 0 && cacheBytes > limit {
+		cache.evict(cacheBytes-int64(float64(limit)*evictionLowWatermark), time.Time{})
+	}
+
+	if limit := totalLimit.Load(); limit > 0 && totalBytes.Load() > limit {
+		evictorOnce.Do(func() { go runEvictor() })
+		select {
+		case evictSignal <- struct{}{}:
+		default:
+			// already signaled
+		}
+	}
+}
+
+func runEvictor() {
+	ticker := time.NewTicker(cacheTTL / 2)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-evictSignal:
+			evictGlobal(loadPlan())
+		case now := <-ticker.C:
+			// entries never read again after sc expired them would be accounted forever
+			for _, c := range loadPlan().caches {
+				c.memory.pruneFilledBefore(now.Add(-cacheTTL))
+			}
+		}
+	}
+}
+
+// evictGlobal evicts the least recently used entries across all caches down to the low watermark.
+// It repeatedly takes the cache whose least recently used entry is the coldest,
+// and evicts its entries up to the coldest entry of the other caches.
+func evictGlobal(plan *cachePlan) {
+	limit := totalLimit.Load()
+	if limit <= 0 {
+		return
+	}
+	target := int64(float64(limit) * evictionLowWatermark)
+	for totalBytes.Load() > target {
+		var coldest, next *cacheWithInfo
+		var coldestAt, nextAt time.Time
+		for _, c := range plan.caches {
+			at, ok := c.memory.coldest()
+			if !ok {
+				continue
+			}
+			switch {
+			case coldest == nil || at.Before(coldestAt):
+				next, nextAt = coldest, coldestAt
+				coldest, coldestAt = &c, at
+			case next == nil || at.Before(nextAt):
+				next, nextAt = &c, at
+			}
+		}
+		if coldest == nil {
+			return
+		}
+		coldest.evict(totalBytes.Load()-target, nextAt)
+	}
+}
+
+func rowSize(r row) int64 {
+	size := rowOverhead
+	for _, v := range r {
+		size += valueOverhead
+		switch v := v.(type) {
+		case []byte:
+			size += int64(len(v))
+		case string:
+			size += int64(len(v))
+		case time.Time:
+			size += int64(unsafe.Sizeof(v))
+		case nil:
+		default:
+			size += 8
+		}
+	}
+	return size
+}
@@ -0,0 +1,200 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/motoki317/sc"
+	"github.com/traP-jp/isuc/domains"
+	"github.com/traP-jp/isuc/normalizer"
+	"gopkg.in/yaml.v3"
+)
+
+const cacheTTL = 10 * time.Minute
+
+// cachePlan is an immutable snapshot of the loaded cache plan.
+// A reload builds a new snapshot and swaps it in, so readers never observe a half-built plan.
+type cachePlan struct {
+	queryMap     map[string]domains.CachePlanQuery
+	caches       map[string]cacheWithInfo
+	cacheByTable map[string][]cacheWithInfo
+	tables       map[string]tableOption
+	// hash identifies the schema and the plan the cached rows were built for
+	hash string
+}
+
+// planOptions holds the driver-specific options written next to "queries" in the plan.
+// isuc does not know about them, so they are decoded separately.
+type planOptions struct {
+	Tables []tableOption `yaml:"tables"`
+}
+
+type tableOption struct {
+	Table string `yaml:"table"`
+	// WriteBehind queues inserts into the table and flushes them in batches.
+	// Only append-only tables with an auto increment "id" column can use it.
+	WriteBehind bool `yaml:"write_behind,omitempty"`
+	// Replicated keeps the whole table in memory and answers single-table queries from it.
+	// Only small tables with an "id" primary key can use it.
+	Replicated bool `yaml:"replicated,omitempty"`
+}
+
+var currentPlan atomic.Pointer[cachePlan]
+
+// reloadMu serializes reloads so that each one builds on the previous snapshot
+var reloadMu sync.Mutex
+
+func loadPlan() *cachePlan {
+	return currentPlan.Load()
+}
+
+// buildPlan parses the raw cache plan and builds a new snapshot.
+// Caches of queries whose plan is unchanged in prev are carried over with their entries.
+func buildPlan(raw io.Reader, prev *cachePlan) (*cachePlan, error) {
+	data, err := io.ReadAll(raw)
+	if err != nil {
+		return nil, err
+	}
+	plan, err := domains.LoadCachePlan(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	var options planOptions
+	if err := yaml.Unmarshal(data, &options); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal plan options: %w", err)
+	}
+
+	p := &cachePlan{
+		queryMap:     make(map[string]domains.CachePlanQuery),
+		caches:       make(map[string]cacheWithInfo),
+		cacheByTable: make(map[string][]cacheWithInfo),
+		tables:       make(map[string]tableOption),
+		hash:         planHash(data),
+	}
+
+	for _, option := range options.Tables {
+		if option.WriteBehind || option.Replicated {
+			id, ok := tableSchema[option.Table].Columns["id"]
+			if !ok || !id.IsPrimary {
+				return nil, fmt.Errorf("write_behind or replicated table %s must have an \"id\" primary key", option.Table)
+			}
+		}
+		if option.WriteBehind && option.Replicated {
+			return nil, fmt.Errorf("table %s cannot be both write_behind and replicated", option.Table)
+		}
+		p.tables[option.Table] = option
+	}
+
+	for _, query := range plan.Queries {
+		normalized := normalizer.NormalizeQuery(query.Query)
+		query.Query = normalized // make sure to use normalized query
+		p.queryMap[normalized] = *query
+		if query.Type != domains.CachePlanQueryType_SELECT || !query.Select.Cache {
+			continue
+		}
+
+		cache := cacheWithInfo{
+			query:      normalized,
+			info:       *query.Select,
+			uniqueOnly: isSingleUniqueCondition(query.Select.Conditions, query.Select.Table),
+		}
+		if prev != nil {
+			if old, ok := prev.caches[normalized]; ok && old.uniqueOnly == cache.uniqueOnly && reflect.DeepEqual(old.info, cache.info) {
+				// keep the entries of the unchanged query
+				cache.cache = old.cache
+				cache.memory = old.memory
+			}
+		}
+		if cache.cache == nil {
+			cache.cache = sc.NewMust(replaceFn, cacheTTL, cacheTTL)
+			cache.memory = newMemoryUsage()
+		}
+		p.caches[normalized] = cache
+
+		// TODO: if query is like "SELECT * FROM WHERE pk IN (?, ?, ...)", generate cache with query "SELECT * FROM table WHERE pk = ?"
+	}
+
+	for _, cache := range p.caches {
+		p.cacheByTable[cache.info.Table] = append(p.cacheByTable[cache.info.Table], cache)
+	}
+
+	return p, nil
+}
+
+func planHash(data []byte) string {
+	h := sha256.New()
+	h.Write([]byte(schemaRaw))
+	h.Write(data)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// ReloadPlan replaces the cache plan with the one read from raw.
+// Entries of queries whose plan is unchanged are kept, and the others are dropped.
+func ReloadPlan(raw io.Reader) error {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	prev := loadPlan()
+	next, err := buildPlan(raw, prev)
+	if err != nil {
+		return fmt.Errorf("failed to build cache plan: %w", err)
+	}
+
+	var kept, dropped int
+	for query, cache := range prev.caches {
+		if c, ok := next.caches[query]; ok && c.cache == cache.cache {
+			kept++
+			continue
+		}
+		// writes may still reference the old cache, so make sure it does not serve stale rows
+		cache.purge()
+		dropped++
+	}
+	currentPlan.Store(next)
+
+	log.Printf("cache plan reloaded: %d queries, %d caches kept, %d caches dropped", len(next.queryMap), kept, dropped)
+	return nil
+}
+
+// resetCaches replaces every cache of the plan with an empty one, dropping its statistics as well.
+func resetCaches() {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+
+	prev := loadPlan()
+	next := &cachePlan{
+		queryMap:     prev.queryMap,
+		caches:       make(map[string]cacheWithInfo, len(prev.caches)),
+		cacheByTable: make(map[string][]cacheWithInfo, len(prev.cacheByTable)),
+		tables:       prev.tables,
+		hash:         prev.hash,
+	}
+	for query, cache := range prev.caches {
+		// writes may still reference the old cache, so make sure it does not serve stale rows
+		cache.purge()
+		cache.cache = sc.NewMust(replaceFn, cacheTTL, cacheTTL)
+		cache.memory = newMemoryUsage()
+		next.caches[query] = cache
+		next.cacheByTable[cache.info.Table] = append(next.cacheByTable[cache.info.Table], cache)
+	}
+	currentPlan.Store(next)
+}
+
+// ReloadPlanFile reloads the cache plan from the yaml file at path.
+func ReloadPlanFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open cache plan: %w", err)
+	}
+	defer f.Close()
+	return ReloadPlan(f)
+}
@@ -0,0 +1,176 @@
+package cache
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+var (
+	readReplicaConnector atomic.Pointer[driver.Connector]
+	// primaryStickiness is how long reads stay on the primary after a write
+	primaryStickiness atomic.Int64
+	// lastWrite is the time of the last write without a session in unix nanoseconds
+	lastWrite atomic.Int64
+	// sessionWrites is the time of the last write of each session (see WithSession)
+	sessionWrites = struct {
+		mu   sync.Mutex
+		last map[string]int64
+	}{last: make(map[string]int64)}
+)
+
+// maxSessionWrites is the number of sessions after which the ones out of their window are swept
+const maxSessionWrites = 1024
+
+// SetReadReplica routes non-transactional cache misses and uncached SELECTs to the MySQL at dsn.
+// For stickyFor after a write, reads of the same session (see WithSession) go to the primary
+// so that they observe the write even if the replica lags behind. Rows read from the replica
+// are cached for stickyFor at most, since they may miss a write that invalidated them.
+func SetReadReplica(dsn string, stickyFor time.Duration) error {
+	cfg, err := mysql.ParseDSN(dsn)
+	if err != nil {
+		return fmt.Errorf("failed to parse replica dsn: %w", err)
+	}
+	// queries are sent with their arguments without preparing them
+	cfg.InterpolateParams = true
+	connector, err := mysql.NewConnector(cfg)
+	if err != nil {
+		return err
+	}
+	primaryStickiness.Store(int64(stickyFor))
+	readReplicaConnector.Store(&connector)
+	return nil
+}
+
+// markWrite starts the window of session in which reads go to the primary.
+func markWrite(session string) {
+	now := time.Now().UnixNano()
+	if session == "" {
+		lastWrite.Store(now)
+		return
+	}
+	sessionWrites.mu.Lock()
+	defer sessionWrites.mu.Unlock()
+	if len(sessionWrites.last) >= maxSessionWrites {
+		deadline := now - primaryStickiness.Load()
+		for s, last := range sessionWrites.last {
+			if last < deadline {
+				delete(sessionWrites.last, s)
+			}
+		}
+	}
+	sessionWrites.last[session] = now
+}
+
+func lastWriteOf(session string) time.Time {
+	if session == "" {
+		return time.Unix(0, lastWrite.Load())
+	}
+	sessionWrites.mu.Lock()
+	defer sessionWrites.mu.Unlock()
+	return time.Unix(0, sessionWrites.last[session])
+}
+
+// readFromReplica reports whether a read on the connection with ctx should go to the read replica.
+func (c *cacheConn) readFromReplica(ctx context.Context) bool {
+	if c.tx || readReplicaConnector.Load() == nil {
+		return false
+	}
+	return time.Since(lastWriteOf(sessionOf(ctx))) > time.Duration(primaryStickiness.Load())
+}
+
+// replicaExpired reports whether rows read from the replica have been cached for longer than the window.
+func replicaExpired(rows *cacheRows) bool {
+	return rows.fromReplica && time.Since(rows.fetchedAt) > time.Duration(primaryStickiness.Load())
+}
+
+// replicaConn returns the connection to the read replica, opening it on first use.
+func (c *cacheConn) replicaConn(ctx context.Context) (driver.Conn, error) {
+	if c.readReplica != nil {
+		return c.readReplica, nil
+	}
+	conn, err := (*readReplicaConnector.Load()).Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	c.readReplica = conn
+	return conn, nil
+}
+
+func (c *cacheConn) closeReplicaConn() {
+	if c.readReplica != nil {
+		c.readReplica.Close()
+		c.readReplica = nil
+	}
+}
+
+// prepareRead prepares an uncached SELECT on the read replica if reads go there.
+func (c *cacheConn) prepareRead(rawQuery string) (driver.Stmt, error) {
+	if !c.readFromReplica(context.Background()) {
+		return c.inner.Prepare(rawQuery)
+	}
+	conn, err := c.replicaConn(context.Background())
+	if err != nil {
+		log.Println("failed to connect to the read replica, falling back to the primary:", err)
+		return c.inner.Prepare(rawQuery)
+	}
+	stmt, err := conn.Prepare(rawQuery)
+	if errors.Is(err, driver.ErrBadConn) {
+		c.closeReplicaConn()
+		return c.inner.Prepare(rawQuery)
+	}
+	return stmt, err
+}
+
+// readQueryer returns where a read outside of the cache should be sent.
+func (c *cacheConn) readQueryer(ctx context.Context) (driver.QueryerContext, route) {
+	if !c.readFromReplica(ctx) {
+		return c.inner.(driver.QueryerContext), routePrimary
+	}
+	conn, err := c.replicaConn(ctx)
+	if err != nil {
+		log.Println("failed to connect to the read replica, falling back to the primary:", err)
+		return c.inner.(driver.QueryerContext), routePrimary
+	}
+	return &replicaQueryer{conn: c, inner: conn.(driver.QueryerContext)}, routeReadReplica
+}
+
+// replicaQueryer falls back to the primary when the replica connection is broken,
+// so that database/sql does not discard the primary connection for the replica's error.
+type replicaQueryer struct {
+	conn  *cacheConn
+	inner driver.QueryerContext
+}
+
+func (q *replicaQueryer) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	rows, err := q.inner.QueryContext(ctx, query, args)
+	if errors.Is(err, driver.ErrBadConn) {
+		log.Println("read replica connection is broken, falling back to the primary")
+		q.conn.closeReplicaConn()
+		return q.conn.inner.(driver.QueryerContext).QueryContext(ctx, query, args)
+	}
+	return rows, err
+}
+
+func routeOf(queryer driver.QueryerContext) route {
+	if _, ok := queryer.(*replicaQueryer); ok {
+		return routeReadReplica
+	}
+	return routePrimary
+}
+
+// query runs a read outside of the cache and records where it went.
+func (c *cacheConn) query(ctx context.Context, normalizedQuery, rawQuery string, nvargs []driver.NamedValue) (driver.Rows, error) {
+	queryer, r := c.readQueryer(ctx)
+	start := time.Now()
+	rows, err := queryer.QueryContext(ctx, rawQuery, nvargs)
+	recordDigest(ctx, normalizedQuery, r, time.Since(start))
+	return rows, err
+}
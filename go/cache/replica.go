@@ -0,0 +1,545 @@
+package cache
+
+import (
+	"cmp"
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"maps"
+	"reflect"
+	"slices"
+	"sort"
+	"sync"
+)
+
+// replica is a full in-memory copy of a small table.
+// It is loaded from the database on first use (and again after it is invalidated),
+// and kept up to date by applying the writes that go through the driver.
+type replica struct {
+	table string
+
+	mu     sync.RWMutex
+	loaded bool
+	// epoch is bumped on every load, so that a write can tell whether the replica was reloaded while it ran
+	epoch       uint64
+	columns     []string
+	columnTypes []columnType
+	index       map[string]int // column -> position in a row
+	idIdx       int
+	rows        []row // sorted by id
+}
+
+var replicas = struct {
+	mu     sync.Mutex
+	tables map[string]*replica
+}{
+	tables: make(map[string]*replica),
+}
+
+func replicaFor(table string) *replica {
+	replicas.mu.Lock()
+	defer replicas.mu.Unlock()
+	r, ok := replicas.tables[table]
+	if !ok {
+		r = &replica{table: table}
+		replicas.tables[table] = r
+	}
+	return r
+}
+
+// invalidateReplicas makes every replica reload the table on its next use.
+func invalidateReplicas() {
+	replicas.mu.Lock()
+	defer replicas.mu.Unlock()
+	for _, r := range replicas.tables {
+		r.invalidate()
+	}
+}
+
+// preloadReplicas loads the replicated tables of the plan in the background.
+func preloadReplicas(plan *cachePlan) {
+	for table, option := range plan.tables {
+		if !option.Replicated {
+			continue
+		}
+		go func() {
+			if err := replicaFor(table).ensureLoaded(context.Background()); err != nil {
+				log.Printf("replica: failed to load %s: %v", table, err)
+			}
+		}()
+	}
+}
+
+func (r *replica) ensureLoaded(ctx context.Context) error {
+	r.mu.RLock()
+	loaded := r.loaded
+	r.mu.RUnlock()
+	if loaded {
+		return nil
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.loaded {
+		return nil
+	}
+	return r.load(ctx)
+}
+
+// load must be called with mu held
+func (r *replica) load(ctx context.Context) error {
+	connector := primaryConnector.Load()
+	if connector == nil {
+		return fmt.Errorf("replica of %s is used before any connection is opened", r.table)
+	}
+	conn, err := (*connector).Connect(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	inner, err := conn.(driver.QueryerContext).QueryContext(ctx, fmt.Sprintf("SELECT * FROM %s ORDER BY id", r.table), nil)
+	if err != nil {
+		return err
+	}
+	defer inner.Close()
+
+	rows, err := newCacheRows(inner)
+	if err != nil {
+		return err
+	}
+	if rows.uncacheable {
+		return fmt.Errorf("table %s has values that cannot be replicated", r.table)
+	}
+	r.columns = rows.columns
+	r.columnTypes = rows.columnTypes
+	r.index = make(map[string]int, len(r.columns))
+	for i, column := range r.columns {
+		r.index[column] = i
+	}
+	r.idIdx = r.index["id"]
+	r.rows = rows.rows.rows
+	r.loaded = true
+	r.epoch++
+	log.Printf("replica: loaded %d rows of %s", len(r.rows), r.table)
+	return nil
+}
+
+func (r *replica) id(rw row) int64 {
+	id, _ := rw[r.idIdx].(int64)
+	return id
+}
+
+// find returns the position of the row with id, or where it should be inserted.
+func (r *replica) find(id int64) (int, bool) {
+	return sort.Find(len(r.rows), func(i int) int {
+		return int(min(max(id-r.id(r.rows[i]), -1), 1))
+	})
+}
+
+// query evaluates a SELECT query against the replica.
+func (r *replica) query(ctx context.Context, q *replicaQuery, args []driver.Value) (*cacheRows, error) {
+	if err := r.ensureLoaded(ctx); err != nil {
+		return nil, err
+	}
+
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if err := r.checkColumns(q); err != nil {
+		return nil, err
+	}
+
+	var matched []row
+	if i, ok := r.lookupByID(q, args); ok {
+		if i >= 0 {
+			matched = []row{r.rows[i]}
+		}
+	} else {
+		for _, rw := range r.rows {
+			if q.match(rw, r.index, args) {
+				matched = append(matched, rw)
+			}
+		}
+	}
+
+	if len(q.orders) > 0 {
+		matched = slices.Clone(matched)
+		slices.SortStableFunc(matched, func(a, b row) int {
+			for _, order := range q.orders {
+				i := r.index[order.column]
+				c, _ := compareValues(a[i], b[i])
+				if order.desc {
+					c = -c
+				}
+				if c != 0 {
+					return c
+				}
+			}
+			return 0
+		})
+	}
+	if q.offset != nil {
+		offset, ok := comparableValue(q.offset.value(args)).(int64)
+		if !ok {
+			return nil, fmt.Errorf("invalid offset: %v", q.offset.value(args))
+		}
+		matched = matched[min(int(max(offset, 0)), len(matched)):]
+	}
+	if q.limit != nil {
+		limit, ok := comparableValue(q.limit.value(args)).(int64)
+		if !ok {
+			return nil, fmt.Errorf("invalid limit: %v", q.limit.value(args))
+		}
+		matched = matched[:min(int(max(limit, 0)), len(matched))]
+	}
+
+	res := &cacheRows{cached: true}
+	switch {
+	case q.count:
+		res.columns = []string{"COUNT(*)"}
+		res.columnTypes = []columnType{{scanType: reflect.TypeOf(int64(0)), databaseTypeName: "BIGINT"}}
+		res.rows.append(row{int64(len(matched))})
+	case q.targets == nil:
+		res.columns = r.columns
+		res.columnTypes = r.columnTypes
+		// rows in the replica are never mutated in place, so they can be shared
+		res.rows.append(matched...)
+	default:
+		res.columns = q.targets
+		res.columnTypes = make([]columnType, len(q.targets))
+		for i, target := range q.targets {
+			res.columnTypes[i] = r.columnTypes[r.index[target]]
+		}
+		for _, rw := range matched {
+			projected := make(row, len(q.targets))
+			for i, target := range q.targets {
+				projected[i] = rw[r.index[target]]
+			}
+			res.rows.append(projected)
+		}
+	}
+	return res, nil
+}
+
+// lookupByID finds the row directly when the only condition is "id = v".
+// ok is false if the query needs a scan; i is -1 if no row matches.
+func (r *replica) lookupByID(q *replicaQuery, args []driver.Value) (i int, ok bool) {
+	if len(q.conditions) != 1 || q.conditions[0].column != "id" || q.conditions[0].operator != "=" {
+		return 0, false
+	}
+	id, isInt := comparableValue(q.conditions[0].values[0].value(args)).(int64)
+	if !isInt {
+		return 0, false
+	}
+	if i, found := r.find(id); found {
+		return i, true
+	}
+	return -1, true
+}
+
+// checkColumns must be called with mu held
+func (r *replica) checkColumns(q *replicaQuery) error {
+	columns := slices.Concat(q.targets, q.columns)
+	for _, cond := range q.conditions {
+		columns = append(columns, cond.column)
+	}
+	for _, order := range q.orders {
+		columns = append(columns, order.column)
+	}
+	for _, set := range q.sets {
+		columns = append(columns, set.column)
+	}
+	for _, column := range columns {
+		if _, ok := r.index[column]; !ok {
+			return fmt.Errorf("%w: unknown column %s in %s", errUnsupportedQuery, column, r.table)
+		}
+	}
+	return nil
+}
+
+// applyLocked applies a write that has been committed to the database.
+// It must be called with mu held.
+func (r *replica) applyLocked(q *replicaQuery, args []driver.Value, lastInsertID int64) error {
+	if err := r.checkColumns(q); err != nil {
+		return err
+	}
+
+	switch q.kind {
+	case replicaInsert:
+		if len(q.columns) != len(r.columns)-1 || slices.Contains(q.columns, "id") {
+			return fmt.Errorf("insert does not set every column but id")
+		}
+		for n, values := range q.values {
+			rw := make(row, len(r.columns))
+			rw[r.idIdx] = lastInsertID + int64(n)
+			for i, column := range q.columns {
+				rw[r.index[column]] = r.storedValue(column, values[i].value(args))
+			}
+			i, found := r.find(r.id(rw))
+			if found {
+				r.rows[i] = rw
+			} else {
+				r.rows = slices.Insert(r.rows, i, rw)
+			}
+		}
+
+	case replicaUpdate:
+		for i, rw := range r.rows {
+			if !q.match(rw, r.index, args) {
+				continue
+			}
+			updated := slices.Clone(rw)
+			for _, set := range q.sets {
+				idx := r.index[set.column]
+				v := set.value.value(args)
+				if set.delta != 0 {
+					cur, ok1 := comparableValue(updated[idx]).(int64)
+					d, ok2 := comparableValue(v).(int64)
+					if !ok1 || !ok2 {
+						return fmt.Errorf("cannot compute %s", set.column)
+					}
+					v = cur + int64(set.delta)*d
+				}
+				updated[idx] = r.storedValue(set.column, v)
+			}
+			// replace instead of mutating, because query results share the rows
+			r.rows[i] = updated
+		}
+		if slices.ContainsFunc(q.sets, func(set replicaSet) bool { return set.column == "id" }) {
+			slices.SortFunc(r.rows, func(a, b row) int { return cmp.Compare(r.id(a), r.id(b)) })
+		}
+
+	case replicaDelete:
+		r.rows = slices.DeleteFunc(r.rows, func(rw row) bool {
+			return q.match(rw, r.index, args)
+		})
+
+	default:
+		return fmt.Errorf("unexpected write")
+	}
+	return nil
+}
+
+// storedValue converts an argument to the type the database returns for the column.
+func (r *replica) storedValue(column string, v driver.Value) driver.Value {
+	v = comparableValue(v)
+	switch r.columnTypes[r.index[column]].scanType.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return v
+	}
+	if s, ok := v.(string); ok {
+		return []byte(s)
+	}
+	return v
+}
+
+// queryReplica answers a SELECT on a replicated table from its replica.
+// ok is false if the query must go to the database.
+func (c *cacheConn) queryReplica(ctx context.Context, plan *cachePlan, rawQuery string, args []driver.Value) (rows driver.Rows, ok bool, err error) {
+	q, err := parseReplicaQuery(rawQuery)
+	if err != nil || q.kind != replicaSelect || q.forUpdate || !plan.tables[q.table].Replicated {
+		return nil, false, nil
+	}
+	if c.tx && c.replicaWrites[q.table] {
+		// the replica does not see the uncommitted writes of this transaction
+		return nil, false, nil
+	}
+	res, err := replicaFor(q.table).query(ctx, q, args)
+	if errors.Is(err, errUnsupportedQuery) {
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, true, err
+	}
+	return res, true, nil
+}
+
+// replicaWrite is a write to be applied to a replica; q is nil if the replica must be reloaded instead
+type replicaWrite struct {
+	table        string
+	q            *replicaQuery
+	args         []driver.Value
+	lastInsertID int64
+	// epoch is the epoch of the replica before the write was run
+	epoch uint64
+}
+
+// applyLocked must be called with mu of the replica held
+func (w replicaWrite) applyLocked(r *replica) {
+	if !r.loaded {
+		// the next load reads the write from the database
+		return
+	}
+	if w.q == nil {
+		r.loaded = false
+		r.rows = nil
+		return
+	}
+	if err := r.applyLocked(w.q, w.args, w.lastInsertID); err != nil {
+		log.Printf("replica: reloading %s: %v", r.table, err)
+		r.loaded = false
+		r.rows = nil
+	}
+}
+
+// replicaEpoch returns the epoch of the replica of the table the raw write modifies.
+// It is read before the write is run and passed to applyReplica.
+func replicaEpoch(plan *cachePlan, rawQuery string) uint64 {
+	table := writtenTable(rawQuery)
+	if !plan.tables[table].Replicated {
+		return 0
+	}
+	r := replicaFor(table)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.epoch
+}
+
+// applyReplica applies a successful write to the replica of its table.
+// Writes in a transaction are applied on commit.
+func (c *cacheConn) applyReplica(plan *cachePlan, rawQuery string, args []driver.Value, res driver.Result, epoch uint64) {
+	q, err := parseReplicaQuery(rawQuery)
+	if err != nil {
+		if table := writtenTable(rawQuery); plan.tables[table].Replicated {
+			log.Printf("replica: reloading %s after unsupported write: %v", table, err)
+			c.addReplicaWrite(replicaWrite{table: table})
+		}
+		return
+	}
+	if q.kind == replicaSelect || !plan.tables[q.table].Replicated {
+		return
+	}
+	w := replicaWrite{table: q.table, q: q, args: args, epoch: epoch}
+	if q.kind == replicaInsert {
+		if w.lastInsertID, err = res.LastInsertId(); err != nil {
+			w.q = nil
+		}
+	}
+	c.addReplicaWrite(w)
+}
+
+func (c *cacheConn) addReplicaWrite(w replicaWrite) {
+	if !c.tx {
+		r := replicaFor(w.table)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		if r.epoch != w.epoch {
+			// a load ran concurrently with the write, and may or may not have read it
+			// (applying "slot = slot - 1" again would count it twice), so load the table again
+			r.loaded = false
+			r.rows = nil
+			return
+		}
+		w.applyLocked(r)
+		return
+	}
+	if c.replicaWrites == nil {
+		c.replicaWrites = make(map[string]bool)
+	}
+	c.replicaWrites[w.table] = true
+	c.pendingReplica = append(c.pendingReplica, w)
+}
+
+// commitWithReplicas commits the transaction and applies its writes to the replicas.
+// The replicas are locked during the commit, so no one reads a replica that lags behind the database.
+func (c *cacheConn) commitWithReplicas(commit func() error) error {
+	defer c.resetReplica()
+	if len(c.pendingReplica) == 0 {
+		return commit()
+	}
+
+	tables := slices.Sorted(maps.Keys(c.replicaWrites))
+	locked := make(map[string]*replica, len(tables))
+	for _, table := range tables {
+		r := replicaFor(table)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		locked[table] = r
+	}
+	if err := commit(); err != nil {
+		return err
+	}
+	for _, w := range c.pendingReplica {
+		w.applyLocked(locked[w.table])
+	}
+	return nil
+}
+
+func (c *cacheConn) resetReplica() {
+	clear(c.replicaWrites)
+	c.pendingReplica = c.pendingReplica[:0]
+}
+
+func (r *replica) invalidate() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.loaded = false
+	r.rows = nil
+}
+
+// writtenTable returns the table name of an INSERT, UPDATE or DELETE query, or "" if it is not one.
+func writtenTable(rawQuery string) string {
+	tokens := tokenizeReplicaQuery(rawQuery)
+	var i int
+	switch {
+	case len(tokens) > 2 && (tokens[0].upper == "INSERT" && tokens[1].upper == "INTO" || tokens[0].upper == "DELETE" && tokens[1].upper == "FROM"):
+		i = 2
+	case len(tokens) > 1 && tokens[0].upper == "UPDATE":
+		i = 1
+	default:
+		return ""
+	}
+	if tokens[i].kind != tokenIdent {
+		return ""
+	}
+	return tokens[i].text
+}
+
+var _ driver.Stmt = &replicaStatement{}
+
+// replicaStatement is a prepared SELECT on a replicated table.
+// It is answered from the replica, and prepared on the database only when it has to go there.
+type replicaStatement struct {
+	conn     *cacheConn
+	rawQuery string
+	inner    driver.Stmt
+	query    *replicaQuery
+}
+
+func (s *replicaStatement) Close() error {
+	if s.inner != nil {
+		return s.inner.Close()
+	}
+	return nil
+}
+
+func (s *replicaStatement) NumInput() int {
+	return s.query.placeholders
+}
+
+func (s *replicaStatement) Exec(args []driver.Value) (driver.Result, error) {
+	return nil, fmt.Errorf("cannot exec a select query")
+}
+
+func (s *replicaStatement) Query(args []driver.Value) (driver.Rows, error) {
+	return s.QueryContext(context.Background(), valueToNamedValue(args))
+}
+
+func (s *replicaStatement) QueryContext(ctx context.Context, nvargs []driver.NamedValue) (driver.Rows, error) {
+	if !bypassed(ctx) {
+		rows, ok, err := s.conn.queryReplica(ctx, loadPlan(), s.rawQuery, namedToValue(nvargs))
+		if ok {
+			return rows, err
+		}
+	}
+	if s.inner == nil {
+		var err error
+		if s.inner, err = s.conn.inner.Prepare(s.rawQuery); err != nil {
+			return nil, err
+		}
+	}
+	return s.inner.(driver.StmtQueryContext).QueryContext(ctx, nvargs)
+}
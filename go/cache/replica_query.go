@@ -0,0 +1,683 @@
+package cache
+
+import (
+	"cmp"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode"
+)
+
+// replicaQuery is a single-table statement that can be evaluated against in-memory rows.
+// The grammar is much smaller than MySQL's; anything else is rejected with errUnsupportedQuery
+// and the statement goes to the database.
+//
+//	SELECT (* | COUNT(*) | col, ...) FROM table [WHERE cond [AND cond ...]] [ORDER BY col [ASC|DESC], ...] [LIMIT n [OFFSET n]] [FOR UPDATE]
+//	INSERT INTO table (col, ...) VALUES (v, ...)[, (v, ...)]
+//	UPDATE table SET col = (v | col + v | col - v), ... [WHERE cond [AND cond ...]]
+//	DELETE FROM table [WHERE cond [AND cond ...]]
+//
+// where cond is "col op v" (op is =, !=, <>, <, <=, > or >=) or "col IN (v, ...)",
+// and v is a placeholder, a number or a string literal.
+type replicaQuery struct {
+	kind  replicaQueryKind
+	table string
+
+	// targets are the selected columns, nil for "*"
+	targets []string
+	count   bool
+	// columns are the inserted columns
+	columns []string
+	values  [][]replicaOperand
+	sets    []replicaSet
+
+	conditions []replicaCondition
+	orders     []replicaOrder
+	limit      *replicaOperand
+	offset     *replicaOperand
+	forUpdate  bool
+
+	placeholders int
+}
+
+type replicaQueryKind int
+
+const (
+	replicaSelect replicaQueryKind = iota
+	replicaInsert
+	replicaUpdate
+	replicaDelete
+)
+
+// replicaOperand is either the placeholder at index or a literal value
+type replicaOperand struct {
+	placeholder int
+	literal     driver.Value
+}
+
+func (o replicaOperand) value(args []driver.Value) driver.Value {
+	if o.placeholder >= 0 {
+		return args[o.placeholder]
+	}
+	return o.literal
+}
+
+type replicaCondition struct {
+	column   string
+	operator string
+	values   []replicaOperand
+}
+
+type replicaOrder struct {
+	column string
+	desc   bool
+}
+
+type replicaSet struct {
+	column string
+	value  replicaOperand
+	// delta is +1 or -1 for "col = col + v" and "col = col - v", and 0 for "col = v"
+	delta int
+}
+
+var errUnsupportedQuery = errors.New("query is not supported by the replica")
+
+// maxParsedReplicaQueries bounds the memo; queries with inlined values beyond it are parsed every time
+const maxParsedReplicaQueries = 4096
+
+var (
+	parsedReplicaQueries sync.Map // raw query -> replicaQueryResult
+	parsedReplicaCount   atomic.Int64
+)
+
+type replicaQueryResult struct {
+	query *replicaQuery
+	err   error
+}
+
+// parseReplicaQuery parses the raw query, memoizing the result.
+func parseReplicaQuery(raw string) (*replicaQuery, error) {
+	if res, ok := parsedReplicaQueries.Load(raw); ok {
+		r := res.(replicaQueryResult)
+		return r.query, r.err
+	}
+	q, err := newReplicaParser(raw).parse()
+	if parsedReplicaCount.Load() < maxParsedReplicaQueries {
+		if _, loaded := parsedReplicaQueries.LoadOrStore(raw, replicaQueryResult{query: q, err: err}); !loaded {
+			parsedReplicaCount.Add(1)
+		}
+	}
+	return q, err
+}
+
+type replicaToken struct {
+	kind  replicaTokenKind
+	text  string
+	upper string
+}
+
+type replicaTokenKind int
+
+const (
+	tokenIdent replicaTokenKind = iota
+	tokenNumber
+	tokenString
+	tokenSymbol
+	tokenPlaceholder
+	tokenEOF
+)
+
+type replicaParser struct {
+	tokens       []replicaToken
+	pos          int
+	placeholders int
+}
+
+func newReplicaParser(raw string) *replicaParser {
+	return &replicaParser{tokens: tokenizeReplicaQuery(raw)}
+}
+
+func tokenizeReplicaQuery(raw string) []replicaToken {
+	var tokens []replicaToken
+	for i := 0; i < len(raw); {
+		c := raw[i]
+		switch {
+		case unicode.IsSpace(rune(c)):
+			i++
+		case c == '`':
+			end := strings.IndexByte(raw[i+1:], '`')
+			if end < 0 {
+				return append(tokens, replicaToken{kind: tokenSymbol, text: raw[i:]})
+			}
+			name := raw[i+1 : i+1+end]
+			tokens = append(tokens, replicaToken{kind: tokenIdent, text: name, upper: "`"})
+			i += end + 2
+		case c == '\'' || c == '"':
+			var b strings.Builder
+			j := i + 1
+			for ; j < len(raw); j++ {
+				if raw[j] == '\\' && j+1 < len(raw) {
+					j++
+					b.WriteByte(raw[j])
+					continue
+				}
+				if raw[j] == c {
+					if j+1 < len(raw) && raw[j+1] == c {
+						// doubled quote
+						b.WriteByte(c)
+						j++
+						continue
+					}
+					break
+				}
+				b.WriteByte(raw[j])
+			}
+			tokens = append(tokens, replicaToken{kind: tokenString, text: b.String()})
+			i = j + 1
+		case c >= '0' && c <= '9':
+			j := i
+			for j < len(raw) && (raw[j] >= '0' && raw[j] <= '9' || raw[j] == '.') {
+				j++
+			}
+			tokens = append(tokens, replicaToken{kind: tokenNumber, text: raw[i:j]})
+			i = j
+		case c == '_' || unicode.IsLetter(rune(c)):
+			j := i
+			for j < len(raw) && (raw[j] == '_' || raw[j] == '.' || unicode.IsLetter(rune(raw[j])) || unicode.IsDigit(rune(raw[j]))) {
+				j++
+			}
+			tokens = append(tokens, replicaToken{kind: tokenIdent, text: raw[i:j], upper: strings.ToUpper(raw[i:j])})
+			i = j
+		case c == '?':
+			tokens = append(tokens, replicaToken{kind: tokenPlaceholder, text: "?"})
+			i++
+		default:
+			if i+1 < len(raw) {
+				if two := raw[i : i+2]; two == "!=" || two == "<>" || two == "<=" || two == ">=" {
+					tokens = append(tokens, replicaToken{kind: tokenSymbol, text: two})
+					i += 2
+					continue
+				}
+			}
+			tokens = append(tokens, replicaToken{kind: tokenSymbol, text: raw[i : i+1]})
+			i++
+		}
+	}
+	return append(tokens, replicaToken{kind: tokenEOF})
+}
+
+func (p *replicaParser) peek() replicaToken {
+	return p.tokens[p.pos]
+}
+
+func (p *replicaParser) next() replicaToken {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEOF {
+		p.pos++
+	}
+	return t
+}
+
+// keyword consumes the keywords if they come next
+func (p *replicaParser) keyword(words ...string) bool {
+	for i, w := range words {
+		t := p.tokens[min(p.pos+i, len(p.tokens)-1)]
+		if t.kind != tokenIdent || t.upper != w {
+			return false
+		}
+	}
+	p.pos += len(words)
+	return true
+}
+
+func (p *replicaParser) symbol(s string) bool {
+	if t := p.peek(); t.kind == tokenSymbol && t.text == s {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *replicaParser) expectKeyword(words ...string) error {
+	if !p.keyword(words...) {
+		return fmt.Errorf("%w: expected %s near %q", errUnsupportedQuery, strings.Join(words, " "), p.peek().text)
+	}
+	return nil
+}
+
+func (p *replicaParser) expectSymbol(s string) error {
+	if !p.symbol(s) {
+		return fmt.Errorf("%w: expected %q near %q", errUnsupportedQuery, s, p.peek().text)
+	}
+	return nil
+}
+
+func (p *replicaParser) identifier() (string, error) {
+	t := p.next()
+	if t.kind != tokenIdent || isReplicaKeyword(t.upper) {
+		return "", fmt.Errorf("%w: expected identifier near %q", errUnsupportedQuery, t.text)
+	}
+	return t.text, nil
+}
+
+func isReplicaKeyword(upper string) bool {
+	switch upper {
+	case "SELECT", "FROM", "WHERE", "AND", "OR", "IN", "ORDER", "BY", "LIMIT", "OFFSET", "FOR", "JOIN", "INNER", "LEFT", "RIGHT", "GROUP", "HAVING", "SET", "VALUES", "AS", "ON", "NOT", "IS", "LIKE", "UNION":
+		return true
+	}
+	return false
+}
+
+func (p *replicaParser) operand() (replicaOperand, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenPlaceholder:
+		p.placeholders++
+		return replicaOperand{placeholder: p.placeholders - 1}, nil
+	case tokenString:
+		return replicaOperand{placeholder: -1, literal: t.text}, nil
+	case tokenNumber:
+		if n, err := strconv.ParseInt(t.text, 10, 64); err == nil {
+			return replicaOperand{placeholder: -1, literal: n}, nil
+		}
+		f, err := strconv.ParseFloat(t.text, 64)
+		if err != nil {
+			return replicaOperand{}, fmt.Errorf("%w: invalid number %q", errUnsupportedQuery, t.text)
+		}
+		return replicaOperand{placeholder: -1, literal: f}, nil
+	case tokenSymbol:
+		if t.text == "-" && p.peek().kind == tokenNumber {
+			o, err := p.operand()
+			if err != nil {
+				return o, err
+			}
+			switch v := o.literal.(type) {
+			case int64:
+				o.literal = -v
+			case float64:
+				o.literal = -v
+			}
+			return o, nil
+		}
+	}
+	return replicaOperand{}, fmt.Errorf("%w: expected value near %q", errUnsupportedQuery, t.text)
+}
+
+func (p *replicaParser) parse() (*replicaQuery, error) {
+	var q *replicaQuery
+	var err error
+	switch {
+	case p.keyword("SELECT"):
+		q, err = p.selectQuery()
+	case p.keyword("INSERT", "INTO"):
+		q, err = p.insertQuery()
+	case p.keyword("UPDATE"):
+		q, err = p.updateQuery()
+	case p.keyword("DELETE", "FROM"):
+		q, err = p.deleteQuery()
+	default:
+		return nil, fmt.Errorf("%w: unknown statement", errUnsupportedQuery)
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.symbol(";")
+	if t := p.peek(); t.kind != tokenEOF {
+		return nil, fmt.Errorf("%w: unexpected %q", errUnsupportedQuery, t.text)
+	}
+	q.placeholders = p.placeholders
+	return q, nil
+}
+
+func (p *replicaParser) selectQuery() (*replicaQuery, error) {
+	q := &replicaQuery{kind: replicaSelect}
+	switch {
+	case p.symbol("*"):
+	case p.keyword("COUNT"):
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("*"); err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		q.count = true
+	default:
+		for {
+			column, err := p.identifier()
+			if err != nil {
+				return nil, err
+			}
+			q.targets = append(q.targets, column)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if err := p.expectKeyword("FROM"); err != nil {
+		return nil, err
+	}
+	table, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	q.table = table
+	if err := p.where(q); err != nil {
+		return nil, err
+	}
+	if p.keyword("ORDER", "BY") {
+		for {
+			column, err := p.identifier()
+			if err != nil {
+				return nil, err
+			}
+			order := replicaOrder{column: column}
+			if p.keyword("DESC") {
+				order.desc = true
+			} else {
+				p.keyword("ASC")
+			}
+			q.orders = append(q.orders, order)
+			if !p.symbol(",") {
+				break
+			}
+		}
+	}
+	if p.keyword("LIMIT") {
+		limit, err := p.operand()
+		if err != nil {
+			return nil, err
+		}
+		q.limit = &limit
+		if p.keyword("OFFSET") {
+			offset, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			q.offset = &offset
+		}
+	}
+	if p.keyword("FOR", "UPDATE") {
+		q.forUpdate = true
+	}
+	return q, nil
+}
+
+func (p *replicaParser) insertQuery() (*replicaQuery, error) {
+	q := &replicaQuery{kind: replicaInsert}
+	table, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	q.table = table
+	if err := p.expectSymbol("("); err != nil {
+		return nil, err
+	}
+	for {
+		column, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		q.columns = append(q.columns, column)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if err := p.expectSymbol(")"); err != nil {
+		return nil, err
+	}
+	if err := p.expectKeyword("VALUES"); err != nil {
+		return nil, err
+	}
+	for {
+		if err := p.expectSymbol("("); err != nil {
+			return nil, err
+		}
+		var values []replicaOperand
+		for {
+			v, err := p.operand()
+			if err != nil {
+				return nil, err
+			}
+			values = append(values, v)
+			if !p.symbol(",") {
+				break
+			}
+		}
+		if err := p.expectSymbol(")"); err != nil {
+			return nil, err
+		}
+		if len(values) != len(q.columns) {
+			return nil, fmt.Errorf("%w: column count does not match value count", errUnsupportedQuery)
+		}
+		q.values = append(q.values, values)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	return q, nil
+}
+
+func (p *replicaParser) updateQuery() (*replicaQuery, error) {
+	q := &replicaQuery{kind: replicaUpdate}
+	table, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	q.table = table
+	if err := p.expectKeyword("SET"); err != nil {
+		return nil, err
+	}
+	for {
+		column, err := p.identifier()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expectSymbol("="); err != nil {
+			return nil, err
+		}
+		set := replicaSet{column: column}
+		if t := p.peek(); t.kind == tokenIdent && t.text == column {
+			// "col = col + v" or "col = col - v"
+			p.next()
+			switch {
+			case p.symbol("+"):
+				set.delta = 1
+			case p.symbol("-"):
+				set.delta = -1
+			default:
+				return nil, fmt.Errorf("%w: unsupported expression for %s", errUnsupportedQuery, column)
+			}
+		}
+		if set.value, err = p.operand(); err != nil {
+			return nil, err
+		}
+		q.sets = append(q.sets, set)
+		if !p.symbol(",") {
+			break
+		}
+	}
+	if err := p.where(q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (p *replicaParser) deleteQuery() (*replicaQuery, error) {
+	q := &replicaQuery{kind: replicaDelete}
+	table, err := p.identifier()
+	if err != nil {
+		return nil, err
+	}
+	q.table = table
+	if err := p.where(q); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+func (p *replicaParser) where(q *replicaQuery) error {
+	if !p.keyword("WHERE") {
+		return nil
+	}
+	for {
+		column, err := p.identifier()
+		if err != nil {
+			return err
+		}
+		cond := replicaCondition{column: column}
+		if p.keyword("IN") {
+			cond.operator = "IN"
+			if err := p.expectSymbol("("); err != nil {
+				return err
+			}
+			for {
+				v, err := p.operand()
+				if err != nil {
+					return err
+				}
+				cond.values = append(cond.values, v)
+				if !p.symbol(",") {
+					break
+				}
+			}
+			if err := p.expectSymbol(")"); err != nil {
+				return err
+			}
+		} else {
+			t := p.next()
+			switch {
+			case t.kind == tokenSymbol && (t.text == "=" || t.text == "!=" || t.text == "<" || t.text == "<=" || t.text == ">" || t.text == ">="):
+				cond.operator = t.text
+			case t.kind == tokenSymbol && t.text == "<>":
+				cond.operator = "!="
+			default:
+				return fmt.Errorf("%w: unsupported operator %q", errUnsupportedQuery, t.text)
+			}
+			v, err := p.operand()
+			if err != nil {
+				return err
+			}
+			cond.values = []replicaOperand{v}
+		}
+		q.conditions = append(q.conditions, cond)
+		if !p.keyword("AND") {
+			return nil
+		}
+	}
+}
+
+// match reports whether the row satisfies every condition of the query.
+func (q *replicaQuery) match(r row, index map[string]int, args []driver.Value) bool {
+	for _, cond := range q.conditions {
+		v := r[index[cond.column]]
+		if v == nil {
+			// comparisons with NULL are never true
+			return false
+		}
+		if cond.operator == "IN" {
+			found := false
+			for _, operand := range cond.values {
+				if c, ok := compareValues(v, operand.value(args)); ok && c == 0 {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+			continue
+		}
+		c, ok := compareValues(v, cond.values[0].value(args))
+		if !ok {
+			return false
+		}
+		switch cond.operator {
+		case "=":
+			ok = c == 0
+		case "!=":
+			ok = c != 0
+		case "<":
+			ok = c < 0
+		case "<=":
+			ok = c <= 0
+		case ">":
+			ok = c > 0
+		case ">=":
+			ok = c >= 0
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// compareValues compares a column value with an argument the way MySQL compares them
+// for the column types used in the schema. ok is false if the values are not comparable.
+func compareValues(a, b driver.Value) (res int, ok bool) {
+	a, b = comparableValue(a), comparableValue(b)
+	switch a := a.(type) {
+	case int64:
+		switch b := b.(type) {
+		case int64:
+			return cmp.Compare(a, b), true
+		case float64:
+			return cmp.Compare(float64(a), b), true
+		case string:
+			f, err := strconv.ParseFloat(b, 64)
+			return cmp.Compare(float64(a), f), err == nil
+		}
+	case float64:
+		switch b := b.(type) {
+		case int64:
+			return cmp.Compare(a, float64(b)), true
+		case float64:
+			return cmp.Compare(a, b), true
+		case string:
+			f, err := strconv.ParseFloat(b, 64)
+			return cmp.Compare(a, f), err == nil
+		}
+	case string:
+		switch b := b.(type) {
+		case string:
+			return strings.Compare(a, b), true
+		case int64, float64:
+			c, ok := compareValues(b, a)
+			return -c, ok
+		}
+	case time.Time:
+		if b, ok := b.(time.Time); ok {
+			return a.Compare(b), true
+		}
+	}
+	return 0, false
+}
+
+func comparableValue(v driver.Value) driver.Value {
+	switch v := v.(type) {
+	case []byte:
+		return string(v)
+	case bool:
+		if v {
+			return int64(1)
+		}
+		return int64(0)
+	case int:
+		return int64(v)
+	case int32:
+		return int64(v)
+	case uint64:
+		return int64(v)
+	case float32:
+		return float64(v)
+	}
+	return v
+}
@@ -0,0 +1,191 @@
+package cache
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"reflect"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+)
+
+// snapshot is the on-disk form of the cached rows
+type snapshot struct {
+	// Hash is the plan hash the rows were cached with; a snapshot of another schema or plan is discarded
+	Hash   string
+	Caches map[string][]snapshotEntry // query -> entries
+}
+
+type snapshotEntry struct {
+	Key         string
+	Columns     []string
+	ColumnTypes []snapshotColumnType
+	Rows        [][]driver.Value
+	FetchedAt   time.Time
+	FromReplica bool
+}
+
+// snapshotColumnType is columnType with the scan type stored by name
+type snapshotColumnType struct {
+	ScanType         string
+	DatabaseTypeName string
+	Nullable         bool
+	HasNullable      bool
+	Length           int64
+	HasLength        bool
+	Precision        int64
+	Scale            int64
+	HasPrecision     bool
+}
+
+// scanTypes are the scan types the mysql driver reports, looked up by name on load
+var scanTypes = func() map[string]reflect.Type {
+	types := make(map[string]reflect.Type)
+	for _, v := range []any{
+		int8(0), int16(0), int32(0), int64(0),
+		uint8(0), uint16(0), uint32(0), uint64(0),
+		float32(0), float64(0), "", []byte(nil), time.Time{},
+		sql.RawBytes(nil), sql.NullInt16{}, sql.NullInt32{}, sql.NullInt64{},
+		sql.NullFloat64{}, sql.NullString{}, sql.NullTime{}, sql.NullBool{}, mysql.NullTime{},
+	} {
+		t := reflect.TypeOf(v)
+		types[t.String()] = t
+	}
+	types[scanTypeAny.String()] = scanTypeAny
+	return types
+}()
+
+func newSnapshotEntry(key string, rows *cacheRows) snapshotEntry {
+	entry := snapshotEntry{
+		Key:         key,
+		Columns:     rows.columns,
+		ColumnTypes: make([]snapshotColumnType, len(rows.columnTypes)),
+		Rows:        rows.rows.rows,
+		FetchedAt:   rows.fetchedAt,
+		FromReplica: rows.fromReplica,
+	}
+	for i, t := range rows.columnTypes {
+		entry.ColumnTypes[i] = snapshotColumnType{
+			ScanType:         t.scanType.String(),
+			DatabaseTypeName: t.databaseTypeName,
+			Nullable:         t.nullable,
+			HasNullable:      t.hasNullable,
+			Length:           t.length,
+			HasLength:        t.hasLength,
+			Precision:        t.precision,
+			Scale:            t.scale,
+			HasPrecision:     t.hasPrecision,
+		}
+	}
+	return entry
+}
+
+func (e snapshotEntry) cacheRows() *cacheRows {
+	rows := &cacheRows{
+		cached:      true,
+		columns:     e.Columns,
+		columnTypes: make([]columnType, len(e.ColumnTypes)),
+		fetchedAt:   e.FetchedAt,
+		fromReplica: e.FromReplica,
+	}
+	for i, t := range e.ColumnTypes {
+		scanType, ok := scanTypes[t.ScanType]
+		if !ok {
+			scanType = scanTypeAny
+		}
+		rows.columnTypes[i] = columnType{
+			scanType:         scanType,
+			databaseTypeName: t.DatabaseTypeName,
+			nullable:         t.Nullable,
+			hasNullable:      t.HasNullable,
+			length:           t.Length,
+			hasLength:        t.HasLength,
+			precision:        t.Precision,
+			scale:            t.Scale,
+			hasPrecision:     t.HasPrecision,
+		}
+	}
+	for _, r := range e.Rows {
+		rows.rows.append(r)
+		rows.size += rowSize(r)
+	}
+	return rows
+}
+
+// SaveSnapshot writes the cached rows to path.
+// It is meant to be called on graceful shutdown and read back by LoadSnapshot on the next start.
+func SaveSnapshot(path string) error {
+	plan := loadPlan()
+	snap := snapshot{
+		Hash:   plan.hash,
+		Caches: make(map[string][]snapshotEntry, len(plan.caches)),
+	}
+	var n int
+	for query, cache := range plan.caches {
+		for _, key := range cache.memory.keys() {
+			rows, ok := cache.cache.GetIfExists(key)
+			if !ok {
+				continue
+			}
+			snap.Caches[query] = append(snap.Caches[query], newSnapshotEntry(key, rows))
+			n++
+		}
+	}
+
+	err := writeFileAtomic(path, func(f *os.File) error {
+		return gob.NewEncoder(f).Encode(snap)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save snapshot: %w", err)
+	}
+	log.Printf("cache snapshot: saved %d entries", n)
+	return nil
+}
+
+// LoadSnapshot fills the caches with the rows saved by SaveSnapshot.
+// A missing file is not an error, and a snapshot taken with another schema or plan is discarded.
+func LoadSnapshot(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open snapshot: %w", err)
+	}
+	defer f.Close()
+
+	var snap snapshot
+	if err := gob.NewDecoder(f).Decode(&snap); err != nil {
+		return fmt.Errorf("failed to decode snapshot: %w", err)
+	}
+	plan := loadPlan()
+	if snap.Hash != plan.hash {
+		log.Println("cache snapshot: discarded because the schema or the plan has changed")
+		return nil
+	}
+
+	var n int
+	for query, entries := range snap.Caches {
+		cache, ok := plan.caches[query]
+		if !ok {
+			continue
+		}
+		for _, entry := range entries {
+			rows := entry.cacheRows()
+			ctx := context.WithValue(context.Background(), preloadKey{}, rows)
+			if _, err := cache.cache.Get(ctx, entry.Key); err != nil {
+				return fmt.Errorf("failed to restore %s: %w", query, err)
+			}
+			cache.memory.touch(entry.Key, rows, time.Now())
+			n++
+		}
+	}
+	log.Printf("cache snapshot: restored %d entries", n)
+	return nil
+}
@@ -3,8 +3,10 @@ package cache
 import (
 	"context"
 	"database/sql/driver"
+	"errors"
 	"log"
 	"slices"
+	"time"
 
 	"github.com/motoki317/sc"
 	"github.com/traP-jp/isuc/domains"
@@ -16,12 +18,50 @@ type cacheWithInfo struct {
 	info       domains.CachePlanSelectQuery
 	uniqueOnly bool // if true, query is like "SELECT * FROM table WHERE pk = ?"
 	cache      *sc.Cache[string, *cacheRows]
+	memory     *memoryUsage
 }
 
-// NOTE: no write happens to this map, so it's safe to use in concurrent environment
-var caches = make(map[string]cacheWithInfo)
+func (c cacheWithInfo) get(ctx context.Context, args []driver.Value) (*cacheRows, error) {
+	key := cacheKey(args)
+	recordAccess(c.query, key, args)
+	start := time.Now()
+	fill := &cacheFill{uniqueOnly: c.uniqueOnly}
+	ctx = context.WithValue(ctx, fillKey{}, fill)
+	rows, err := c.cache.Get(ctx, key)
+	if err == nil && (tooStale(ctx, rows) || replicaExpired(rows)) {
+		c.forget(key)
+		rows, err = c.cache.Get(ctx, key)
+	}
+	recordDigest(ctx, c.query, routeCache, time.Since(start))
+	recordCacheRead(ctx, !fill.missed)
+	if uerr := (*uncacheableError)(nil); errors.As(err, &uerr) {
+		// the rows were fetched but not stored; callers waiting on the same fill share them, so hand out copies
+		return uerr.rows.clone(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	cacheBytes := c.memory.touch(key, rows, time.Now())
+	enforceMemoryLimits(c, cacheBytes)
+	return rows, nil
+}
+
+func (c cacheWithInfo) forget(key string) {
+	c.cache.Forget(key)
+	c.memory.remove(key)
+}
 
-var cacheByTable = make(map[string][]cacheWithInfo)
+// evict forgets the least recently used entries until need bytes are freed (see memoryUsage.popColdest).
+func (c cacheWithInfo) evict(need int64, until time.Time) {
+	for _, key := range c.memory.popColdest(need, until) {
+		c.cache.Forget(key)
+	}
+}
+
+func (c cacheWithInfo) purge() {
+	c.cache.Purge()
+	c.memory.reset()
+}
 
 var _ driver.Stmt = &customCacheStatement{}
 
@@ -43,33 +83,61 @@ func (s *customCacheStatement) NumInput() int {
 }
 
 func (s *customCacheStatement) Exec(args []driver.Value) (driver.Result, error) {
+	return s.ExecContext(context.Background(), valueToNamedValue(args))
+}
+
+func (s *customCacheStatement) ExecContext(ctx context.Context, nvargs []driver.NamedValue) (driver.Result, error) {
+	args := namedToValue(nvargs)
+	var res driver.Result
+	var err error
+	if s.queryInfo.Type != domains.CachePlanQueryType_INSERT || !loadPlan().tables[s.queryInfo.Insert.Table].WriteBehind {
+		if err := s.conn.flushPendingWritesFor(ctx, s.query); err != nil {
+			return nil, err
+		}
+	}
+	epoch := replicaEpoch(loadPlan(), s.rawQuery)
+	start := time.Now()
+	defer func() {
+		recordDigest(ctx, s.query, writeRoute(loadPlan(), s.queryInfo), time.Since(start))
+		markWrite(sessionOf(ctx))
+	}()
 	switch s.queryInfo.Type {
 	case domains.CachePlanQueryType_INSERT:
-		return s.execInsert(args)
+		res, err = s.execInsert(ctx, args)
 	case domains.CachePlanQueryType_UPDATE:
-		return s.execUpdate(args)
+		res, err = s.execUpdate(ctx, args)
 	case domains.CachePlanQueryType_DELETE:
-		return s.execDelete(args)
+		res, err = s.execDelete(ctx, args)
+	default:
+		res, err = s.inner.(driver.StmtExecContext).ExecContext(ctx, nvargs)
+	}
+	if err != nil {
+		return nil, err
 	}
 
-	return s.inner.(driver.StmtExecContext).ExecContext(context.Background(), valueToNamedValue(args))
+	s.conn.applyReplica(loadPlan(), s.rawQuery, args, res, epoch)
+	return res, nil
 }
 
-func (s *customCacheStatement) execInsert(args []driver.Value) (driver.Result, error) {
-	handleInsertQuery(s.query, *s.queryInfo.Insert, args)
-	return s.inner.(driver.StmtExecContext).ExecContext(context.Background(), valueToNamedValue(args))
+func (s *customCacheStatement) execInsert(ctx context.Context, args []driver.Value) (driver.Result, error) {
+	plan := loadPlan()
+	handleInsertQuery(plan, s.query, *s.queryInfo.Insert, args)
+	if plan.tables[s.queryInfo.Insert.Table].WriteBehind {
+		return s.conn.execWriteBehind(ctx, s.queryInfo.Insert.Table, s.queryInfo.Insert.Columns, args)
+	}
+	return s.inner.(driver.StmtExecContext).ExecContext(ctx, valueToNamedValue(args))
 }
 
-func (s *customCacheStatement) execUpdate(args []driver.Value) (driver.Result, error) {
-	handleUpdateQuery(*s.queryInfo.Update, args)
+func (s *customCacheStatement) execUpdate(ctx context.Context, args []driver.Value) (driver.Result, error) {
+	handleUpdateQuery(loadPlan(), *s.queryInfo.Update, args)
 	nvarsgs := valueToNamedValue(args)
-	return s.inner.(driver.StmtExecContext).ExecContext(context.Background(), nvarsgs)
+	return s.inner.(driver.StmtExecContext).ExecContext(ctx, nvarsgs)
 }
 
-func (s *customCacheStatement) execDelete(args []driver.Value) (driver.Result, error) {
-	handleDeleteQuery(*s.queryInfo.Delete, args)
+func (s *customCacheStatement) execDelete(ctx context.Context, args []driver.Value) (driver.Result, error) {
+	handleDeleteQuery(loadPlan(), *s.queryInfo.Delete, args)
 	nvargs := valueToNamedValue(args)
-	return s.inner.(driver.StmtExecContext).ExecContext(context.Background(), nvargs)
+	return s.inner.(driver.StmtExecContext).ExecContext(ctx, nvargs)
 }
 
 func (c *cacheConn) ExecContext(ctx context.Context, rawQuery string, nvargs []driver.NamedValue) (driver.Result, error) {
@@ -80,25 +148,56 @@ func (c *cacheConn) ExecContext(ctx context.Context, rawQuery string, nvargs []d
 
 	normalizedQuery := normalizer.NormalizeQuery(rawQuery)
 
-	queryInfo, ok := queryMap[normalizedQuery]
+	plan := loadPlan()
+	queryInfo, ok := plan.queryMap[normalizedQuery]
 	if !ok {
 		log.Println("unknown query:", normalizedQuery)
 		PurgeAllCaches()
-		return inner.ExecContext(ctx, rawQuery, nvargs)
+		if err := c.flushPendingWritesFor(ctx, normalizedQuery); err != nil {
+			return nil, err
+		}
+		if err := flushWriteBehindFor(ctx, normalizedQuery); err != nil {
+			return nil, err
+		}
+		epoch := replicaEpoch(plan, rawQuery)
+		start := time.Now()
+		res, err := inner.ExecContext(ctx, rawQuery, nvargs)
+		recordDigest(ctx, normalizedQuery, routePrimary, time.Since(start))
+		markWrite(sessionOf(ctx))
+		if err == nil {
+			c.applyReplica(plan, rawQuery, namedToValue(nvargs), res, epoch)
+		}
+		return res, err
+	}
+	if queryInfo.Type != domains.CachePlanQueryType_INSERT || !plan.tables[queryInfo.Insert.Table].WriteBehind {
+		// make sure the queued inserts are applied before the table is modified
+		if err := c.flushPendingWritesFor(ctx, normalizedQuery); err != nil {
+			return nil, err
+		}
+		if err := flushWriteBehindFor(ctx, normalizedQuery); err != nil {
+			return nil, err
+		}
 	}
 
 	var res driver.Result
 	var err error
+	epoch := replicaEpoch(plan, rawQuery)
+	start := time.Now()
 	switch queryInfo.Type {
 	case domains.CachePlanQueryType_INSERT:
-		res, err = c.execInsert(ctx, rawQuery, queryInfo, nvargs, inner)
+		res, err = c.execInsert(ctx, plan, rawQuery, queryInfo, nvargs, inner)
 	case domains.CachePlanQueryType_UPDATE:
-		res, err = c.execUpdate(ctx, rawQuery, queryInfo, nvargs, inner)
+		res, err = c.execUpdate(ctx, plan, rawQuery, queryInfo, nvargs, inner)
 	case domains.CachePlanQueryType_DELETE:
-		res, err = c.execDelete(ctx, rawQuery, queryInfo, nvargs, inner)
+		res, err = c.execDelete(ctx, plan, rawQuery, queryInfo, nvargs, inner)
 	default:
 		res, err = inner.ExecContext(ctx, rawQuery, nvargs)
 	}
+	recordDigest(ctx, normalizedQuery, writeRoute(plan, queryInfo), time.Since(start))
+	markWrite(sessionOf(ctx))
+	if err == nil {
+		c.applyReplica(plan, rawQuery, namedToValue(nvargs), res, epoch)
+	}
 
 	if !c.tx {
 		for _, cleanUp := range c.cleanUp {
@@ -110,47 +209,72 @@ func (c *cacheConn) ExecContext(ctx context.Context, rawQuery string, nvargs []d
 	return res, err
 }
 
-func (c *cacheConn) execInsert(ctx context.Context, rawQuery string, queryInfo domains.CachePlanQuery, nvargs []driver.NamedValue, inner driver.ExecerContext) (driver.Result, error) {
+func (c *cacheConn) execInsert(ctx context.Context, plan *cachePlan, rawQuery string, queryInfo domains.CachePlanQuery, nvargs []driver.NamedValue, inner driver.ExecerContext) (driver.Result, error) {
 	args := make([]driver.Value, 0, len(nvargs))
 	for _, nv := range nvargs {
 		args = append(args, nv.Value)
 	}
 
-	cleanUp := handleInsertQuery(queryInfo.Query, *queryInfo.Insert, args)
+	cleanUp := handleInsertQuery(plan, queryInfo.Query, *queryInfo.Insert, args)
 	c.cleanUp = append(c.cleanUp, cleanUp...)
 
+	if plan.tables[queryInfo.Insert.Table].WriteBehind {
+		return c.execWriteBehind(ctx, queryInfo.Insert.Table, queryInfo.Insert.Columns, args)
+	}
 	return inner.ExecContext(ctx, rawQuery, nvargs)
 }
 
-func (c *cacheConn) execUpdate(ctx context.Context, rawQuery string, queryInfo domains.CachePlanQuery, nvargs []driver.NamedValue, inner driver.ExecerContext) (driver.Result, error) {
+func (c *cacheConn) execUpdate(ctx context.Context, plan *cachePlan, rawQuery string, queryInfo domains.CachePlanQuery, nvargs []driver.NamedValue, inner driver.ExecerContext) (driver.Result, error) {
 	args := namedToValue(nvargs)
 
-	cleanUp := handleUpdateQuery(*queryInfo.Update, args)
+	cleanUp := handleUpdateQuery(plan, *queryInfo.Update, args)
 	c.cleanUp = append(c.cleanUp, cleanUp...)
 
 	return inner.ExecContext(ctx, rawQuery, nvargs)
 }
 
-func (c *cacheConn) execDelete(ctx context.Context, rawQuery string, queryInfo domains.CachePlanQuery, nvargs []driver.NamedValue, inner driver.ExecerContext) (driver.Result, error) {
+func (c *cacheConn) execDelete(ctx context.Context, plan *cachePlan, rawQuery string, queryInfo domains.CachePlanQuery, nvargs []driver.NamedValue, inner driver.ExecerContext) (driver.Result, error) {
 	args := namedToValue(nvargs)
 
-	cleanUp := handleDeleteQuery(*queryInfo.Delete, args)
+	cleanUp := handleDeleteQuery(plan, *queryInfo.Delete, args)
 	c.cleanUp = append(c.cleanUp, cleanUp...)
 
 	return inner.ExecContext(ctx, rawQuery, nvargs)
 }
 
 func (s *customCacheStatement) Query(args []driver.Value) (driver.Rows, error) {
-	ctx := context.WithValue(context.Background(), stmtKey{}, s)
-	ctx = context.WithValue(ctx, argsKey{}, args)
+	return s.QueryContext(context.Background(), valueToNamedValue(args))
+}
+
+func (s *customCacheStatement) QueryContext(ctx context.Context, nvargs []driver.NamedValue) (driver.Rows, error) {
+	if err := s.conn.flushPendingWritesFor(ctx, s.query); err != nil {
+		return nil, err
+	}
+	if bypassed(ctx) || s.conn.tx {
+		if err := flushWriteBehindFor(ctx, s.query); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		rows, err := s.inner.(driver.StmtQueryContext).QueryContext(ctx, nvargs)
+		recordDigest(ctx, s.query, routePrimary, time.Since(start))
+		return rows, err
+	}
 
+	args := namedToValue(nvargs)
 	conditions := s.queryInfo.Select.Conditions
 	// if query is like "SELECT * FROM table WHERE cond IN (?, ?, ?, ...)"
 	if len(conditions) == 1 && conditions[0].Operator == domains.CachePlanOperator_IN {
-		return s.inQuery(args)
+		return s.inQuery(ctx, args)
 	}
 
-	rows, err := caches[cacheName(s.query)].cache.Get(ctx, cacheKey(args))
+	cache, ok := loadPlan().caches[cacheName(s.query)]
+	if !ok {
+		// the query is no longer cached since the plan was reloaded
+		return s.inner.(driver.StmtQueryContext).QueryContext(ctx, nvargs)
+	}
+	cacheCtx := context.WithValue(ctx, stmtKey{}, s)
+	cacheCtx = context.WithValue(cacheCtx, argsKey{}, args)
+	rows, err := cache.get(cacheCtx, args)
 	if err != nil {
 		return nil, err
 	}
@@ -158,41 +282,56 @@ func (s *customCacheStatement) Query(args []driver.Value) (driver.Rows, error) {
 	return rows, nil
 }
 
-func (s *customCacheStatement) inQuery(args []driver.Value) (driver.Rows, error) {
+func (s *customCacheStatement) inQuery(ctx context.Context, args []driver.Value) (driver.Rows, error) {
 	// "SELECT * FROM table WHERE cond IN (?, ?, ...)"
 	// separate the query into multiple queries and merge the results
+	plan := loadPlan()
 	table := s.queryInfo.Select.Table
 	condIdx := s.queryInfo.Select.Conditions[0].Placeholder.Index
 	condValues := args[condIdx:]
 
 	// find the query "SELECT * FROM table WHERE cond = ?"
 	var cache *cacheWithInfo
-	for _, c := range cacheByTable[table] {
+	for _, c := range plan.cacheByTable[table] {
 		if len(c.info.Conditions) == 1 && c.info.Conditions[0].Column == s.queryInfo.Select.Conditions[0].Column && c.info.Conditions[0].Operator == domains.CachePlanOperator_EQ {
 			cache = &c
 		}
 	}
 	if cache == nil {
-		return s.inner.(driver.StmtQueryContext).QueryContext(context.Background(), valueToNamedValue(args))
+		return s.inner.(driver.StmtQueryContext).QueryContext(ctx, valueToNamedValue(args))
 	}
 
 	allRows := make([]*cacheRows, 0, len(condValues))
+	seen := make(map[string]bool, len(condValues))
 	for _, condValue := range condValues {
-		// prepare new statement
-		stmt, err := s.conn.Prepare(cache.query)
+		// a value listed twice matches the rows only once
+		key := cacheKey([]driver.Value{condValue})
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		stmt, err := s.conn.prepareCached(cache.query)
 		if err != nil {
 			return nil, err
 		}
-		ctx := context.WithValue(context.Background(), stmtKey{}, stmt)
-		ctx = context.WithValue(ctx, argsKey{}, []driver.Value{condValue})
-		rows, err := cache.cache.Get(ctx, cacheKey([]driver.Value{condValue}))
+		cacheCtx := context.WithValue(ctx, stmtKey{}, stmt)
+		cacheCtx = context.WithValue(cacheCtx, argsKey{}, []driver.Value{condValue})
+		rows, err := cache.get(cacheCtx, []driver.Value{condValue})
 		if err != nil {
 			return nil, err
 		}
 		allRows = append(allRows, rows)
 	}
 
-	return mergeCachedRows(allRows), nil
+	merged := mergeCachedRows(allRows)
+	if len(s.queryInfo.Select.Orders) > 0 && merged != nil {
+		if len(allRows) == 1 {
+			// do not reorder the cached rows themselves
+			merged = merged.clone()
+		}
+		sortCachedRows(merged, s.queryInfo.Select.Orders)
+	}
+	return merged, nil
 }
 
 func (c *cacheConn) QueryContext(ctx context.Context, rawQuery string, nvargs []driver.NamedValue) (driver.Rows, error) {
@@ -201,27 +340,61 @@ func (c *cacheConn) QueryContext(ctx context.Context, rawQuery string, nvargs []
 		return nil, driver.ErrSkip
 	}
 
+	normalizedQuery := normalizer.NormalizeQuery(rawQuery)
+
+	// the transaction reads its own write-behind inserts
+	if err := c.flushPendingWritesFor(ctx, normalizedQuery); err != nil {
+		return nil, err
+	}
+
+	if bypassed(ctx) {
+		if err := flushWriteBehindFor(ctx, normalizedQuery); err != nil {
+			return nil, err
+		}
+		start := time.Now()
+		rows, err := inner.QueryContext(ctx, rawQuery, nvargs)
+		recordDigest(ctx, normalizedQuery, routePrimary, time.Since(start))
+		return rows, err
+	}
+
+	plan := loadPlan()
+	start := time.Now()
+	if rows, ok, err := c.queryReplica(ctx, plan, rawQuery, namedToValue(nvargs)); ok {
+		recordDigest(ctx, normalizedQuery, routeMemory, time.Since(start))
+		return rows, err
+	}
+
 	if c.tx {
 		log.Println("cache skip because of transaction:", rawQuery)
-		return inner.QueryContext(ctx, rawQuery, nvargs)
+		if err := flushWriteBehindFor(ctx, normalizedQuery); err != nil {
+			return nil, err
+		}
+		return c.query(ctx, normalizedQuery, rawQuery, nvargs)
 	}
 
-	normalizedQuery := normalizer.NormalizeQuery(rawQuery)
-
-	queryInfo, ok := queryMap[normalizedQuery]
+	queryInfo, ok := plan.queryMap[normalizedQuery]
 	if !ok {
 		log.Println("unknown query:", normalizedQuery)
-		return inner.QueryContext(ctx, rawQuery, nvargs)
+		if err := flushWriteBehindFor(ctx, normalizedQuery); err != nil {
+			return nil, err
+		}
+		return c.query(ctx, normalizedQuery, rawQuery, nvargs)
 	}
 	if queryInfo.Type != domains.CachePlanQueryType_SELECT || !queryInfo.Select.Cache {
 		log.Println("cache skip because of query type:", normalizedQuery)
-		return inner.QueryContext(ctx, rawQuery, nvargs)
+		if err := flushWriteBehindFor(ctx, normalizedQuery); err != nil {
+			return nil, err
+		}
+		return c.query(ctx, normalizedQuery, rawQuery, nvargs)
 	}
 
+	// cache misses go to the read replica unless a write has just been made
+	inner, _ = c.readQueryer(ctx)
+
 	conditions := queryInfo.Select.Conditions
 	// if query is like "SELECT * FROM table WHERE cond IN (?, ?, ?, ...)"
 	if len(conditions) == 1 && conditions[0].Operator == domains.CachePlanOperator_IN {
-		return c.inQuery(ctx, rawQuery, nvargs, inner)
+		return c.inQuery(ctx, plan, rawQuery, nvargs, inner)
 	}
 
 	args := make([]driver.Value, len(nvargs))
@@ -229,11 +402,11 @@ func (c *cacheConn) QueryContext(ctx context.Context, rawQuery string, nvargs []
 		args[i] = nv.Value
 	}
 
-	cache := caches[queryInfo.Query].cache
+	cache := plan.caches[queryInfo.Query]
 	cachectx := context.WithValue(ctx, namedValueArgsKey{}, nvargs)
 	cachectx = context.WithValue(cachectx, queryerCtxKey{}, inner)
 	cachectx = context.WithValue(cachectx, queryKey{}, rawQuery)
-	rows, err := cache.Get(cachectx, cacheKey(args))
+	rows, err := cache.get(cachectx, args)
 	if err != nil {
 		return nil, err
 	}
@@ -241,19 +414,19 @@ func (c *cacheConn) QueryContext(ctx context.Context, rawQuery string, nvargs []
 	return rows, nil
 }
 
-func (c *cacheConn) inQuery(ctx context.Context, query string, args []driver.NamedValue, inner driver.QueryerContext) (driver.Rows, error) {
+func (c *cacheConn) inQuery(ctx context.Context, plan *cachePlan, query string, args []driver.NamedValue, inner driver.QueryerContext) (driver.Rows, error) {
 	// "SELECT * FROM table WHERE cond IN (?, ?, ...)"
 	// separate the query into multiple queries and merge the results
 	normalizedQuery := normalizer.NormalizeQuery(query)
 
-	queryInfo := queryMap[normalizedQuery]
+	queryInfo := plan.queryMap[normalizedQuery]
 	table := queryInfo.Select.Table
 	condIdx := queryInfo.Select.Conditions[0].Placeholder.Index
 	condValues := args[condIdx:]
 
 	// find the query "SELECT * FROM table WHERE cond = ?"
 	var cache *cacheWithInfo
-	for _, c := range cacheByTable[table] {
+	for _, c := range plan.cacheByTable[table] {
 		if len(c.info.Conditions) == 1 && c.info.Conditions[0].Column == queryInfo.Select.Conditions[0].Column && c.info.Conditions[0].Operator == domains.CachePlanOperator_EQ {
 			cache = &c
 		}
@@ -263,28 +436,67 @@ func (c *cacheConn) inQuery(ctx context.Context, query string, args []driver.Nam
 	}
 
 	allRows := make([]*cacheRows, 0, len(condValues))
+	seen := make(map[string]bool, len(condValues))
 	for _, condValue := range condValues {
+		// a value listed twice matches the rows only once
+		key := cacheKey([]driver.Value{condValue.Value})
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
 		nvargs := []driver.NamedValue{condValue}
 		cacheCtx := context.WithValue(ctx, queryKey{}, cache.query)
 		cacheCtx = context.WithValue(cacheCtx, queryerCtxKey{}, inner)
 		cacheCtx = context.WithValue(cacheCtx, namedValueArgsKey{}, nvargs)
-		rows, err := cache.cache.Get(cacheCtx, cacheKey([]driver.Value{condValue.Value}))
+		rows, err := cache.get(cacheCtx, []driver.Value{condValue.Value})
 		if err != nil {
 			return nil, err
 		}
 		allRows = append(allRows, rows)
 	}
 
-	return mergeCachedRows(allRows), nil
+	merged := mergeCachedRows(allRows)
+	if len(queryInfo.Select.Orders) > 0 && merged != nil {
+		if len(allRows) == 1 {
+			// do not reorder the cached rows themselves
+			merged = merged.clone()
+		}
+		sortCachedRows(merged, queryInfo.Select.Orders)
+	}
+	return merged, nil
+}
+
+// sortCachedRows orders the rows merged from several keys as the ORDER BY of the query does.
+func sortCachedRows(rows *cacheRows, orders []domains.CachePlanOrder) {
+	index := make(map[string]int, len(rows.columns))
+	for i, column := range rows.columns {
+		index[column] = i
+	}
+	slices.SortStableFunc(rows.rows.rows, func(a, b row) int {
+		for _, order := range orders {
+			i, ok := index[order.Column]
+			if !ok {
+				continue
+			}
+			c, _ := compareValues(a[i], b[i])
+			if order.Order == domains.CachePlanOrder_DESC {
+				c = -c
+			}
+			if c != 0 {
+				return c
+			}
+		}
+		return 0
+	})
 }
 
-func handleInsertQuery(query string, queryInfo domains.CachePlanInsertQuery, insertValues []driver.Value) (cleanUP []func()) {
+func handleInsertQuery(plan *cachePlan, query string, queryInfo domains.CachePlanInsertQuery, insertValues []driver.Value) (cleanUP []func()) {
 	table := queryInfo.Table
 	insertArgs, _ := normalizer.NormalizeArgs(query)
 
 	rows := slices.Chunk(insertValues, len(queryInfo.Columns))
 
-	for _, cache := range cacheByTable[table] {
+	for _, cache := range plan.cacheByTable[table] {
 		if cache.uniqueOnly {
 			// no need to purge
 			continue
@@ -293,7 +505,7 @@ func handleInsertQuery(query string, queryInfo domains.CachePlanInsertQuery, ins
 		cacheConditions := cache.info.Conditions
 		isComplexQuery := len(cacheConditions) != 1 || len(insertArgs.ExtraArgs) > 0 || cacheConditions[0].Operator != domains.CachePlanOperator_EQ
 		if isComplexQuery {
-			cleanUP = append(cleanUP, cache.cache.Purge)
+			cleanUP = append(cleanUP, cache.purge)
 			continue
 		}
 
@@ -304,29 +516,29 @@ func handleInsertQuery(query string, queryInfo domains.CachePlanInsertQuery, ins
 			// select query: "SELECT * FROM table WHERE col1 = ?"
 			// forget the cache
 			for row := range rows {
-				cleanUP = append(cleanUP, func() { cache.cache.Forget(cacheKey([]driver.Value{row[insertColumnIdx]})) })
+				cleanUP = append(cleanUP, func() { cache.forget(cacheKey([]driver.Value{row[insertColumnIdx]})) })
 			}
 		} else {
-			cleanUP = append(cleanUP, cache.cache.Purge)
+			cleanUP = append(cleanUP, cache.purge)
 		}
 	}
 
 	return cleanUP
 }
 
-func handleUpdateQuery(queryInfo domains.CachePlanUpdateQuery, args []driver.Value) (cleanUp []func()) {
+func handleUpdateQuery(plan *cachePlan, queryInfo domains.CachePlanUpdateQuery, args []driver.Value) (cleanUp []func()) {
 	// TODO: support composite primary key and other unique key
 	table := queryInfo.Table
 	updateConditions := queryInfo.Conditions
 
 	// if query is NOT "UPDATE `table` SET ... WHERE `unique_col` = ?"
 	if !isSingleUniqueCondition(updateConditions, table) {
-		for _, cache := range cacheByTable[table] {
+		for _, cache := range plan.cacheByTable[table] {
 			if !usedBySelectQuery(cache.info.Targets, queryInfo.Targets) {
 				// no need to purge because the cache does not contain the updated column
 				continue
 			}
-			cleanUp = append(cleanUp, cache.cache.Purge)
+			cleanUp = append(cleanUp, cache.purge)
 		}
 		return
 	}
@@ -334,7 +546,7 @@ func handleUpdateQuery(queryInfo domains.CachePlanUpdateQuery, args []driver.Val
 	updateCondition := updateConditions[0]
 	uniqueValue := args[updateCondition.Placeholder.Index]
 
-	for _, cache := range cacheByTable[table] {
+	for _, cache := range plan.cacheByTable[table] {
 		if !usedBySelectQuery(cache.info.Targets, queryInfo.Targets) {
 			// no need to purge because the cache does not contain the updated column
 			continue
@@ -343,16 +555,16 @@ func handleUpdateQuery(queryInfo domains.CachePlanUpdateQuery, args []driver.Val
 		cacheConditions := cache.info.Conditions
 		if isSingleUniqueCondition(cacheConditions, table) && cacheConditions[0].Column == updateCondition.Column {
 			// forget only the updated row
-			cleanUp = append(cleanUp, func() { cache.cache.Forget(cacheKey([]driver.Value{uniqueValue})) })
+			cleanUp = append(cleanUp, func() { cache.forget(cacheKey([]driver.Value{uniqueValue})) })
 		} else {
-			cleanUp = append(cleanUp, cache.cache.Purge)
+			cleanUp = append(cleanUp, cache.purge)
 		}
 	}
 
 	return cleanUp
 }
 
-func handleDeleteQuery(queryInfo domains.CachePlanDeleteQuery, args []driver.Value) (cleanUp []func()) {
+func handleDeleteQuery(plan *cachePlan, queryInfo domains.CachePlanDeleteQuery, args []driver.Value) (cleanUp []func()) {
 	table := queryInfo.Table
 
 	// if query is like "DELETE FROM table WHERE unique = ?"
@@ -364,21 +576,21 @@ func handleDeleteQuery(queryInfo domains.CachePlanDeleteQuery, args []driver.Val
 	}
 	if !deleteByUnique {
 		// we should purge all cache
-		for _, cache := range cacheByTable[table] {
-			cleanUp = append(cleanUp, cache.cache.Purge)
+		for _, cache := range plan.cacheByTable[table] {
+			cleanUp = append(cleanUp, cache.purge)
 		}
 		return
 	}
 
 	uniqueValue := args[queryInfo.Conditions[0].Placeholder.Index]
 
-	for _, cache := range cacheByTable[table] {
+	for _, cache := range plan.cacheByTable[table] {
 		if cache.uniqueOnly {
 			// query like "SELECT * FROM table WHERE pk = ?"
 			// we should forget the cache
-			cleanUp = append(cleanUp, func() { cache.cache.Forget(cacheKey([]driver.Value{uniqueValue})) })
+			cleanUp = append(cleanUp, func() { cache.forget(cacheKey([]driver.Value{uniqueValue})) })
 		} else {
-			cleanUp = append(cleanUp, cache.cache.Purge)
+			cleanUp = append(cleanUp, cache.purge)
 		}
 	}
 
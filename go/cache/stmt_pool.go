@@ -0,0 +1,71 @@
+package cache
+
+import (
+	"container/list"
+	"fmt"
+
+	"github.com/traP-jp/isuc/normalizer"
+)
+
+// maxPooledStmts is the number of prepared statements kept open per connection
+const maxPooledStmts = 64
+
+// stmtPool is a per-connection LRU of prepared statements keyed by normalized query.
+// Statements in the pool are owned by the pool, so callers must not close them.
+type stmtPool struct {
+	lru   *list.List // of *pooledStmt, most recently used first
+	stmts map[string]*list.Element
+}
+
+type pooledStmt struct {
+	query string
+	stmt  *customCacheStatement
+}
+
+func newStmtPool() *stmtPool {
+	return &stmtPool{
+		lru:   list.New(),
+		stmts: make(map[string]*list.Element),
+	}
+}
+
+// prepareCached returns a pooled statement for query, preparing it on the first use.
+func (c *cacheConn) prepareCached(query string) (*customCacheStatement, error) {
+	normalized := normalizer.NormalizeQuery(query)
+	if elem, ok := c.stmts.stmts[normalized]; ok {
+		c.stmts.lru.MoveToFront(elem)
+		return elem.Value.(*pooledStmt).stmt, nil
+	}
+
+	stmt, err := c.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	cacheStmt, ok := stmt.(*customCacheStatement)
+	if !ok {
+		stmt.Close()
+		return nil, fmt.Errorf("query is not cached: %s", normalized)
+	}
+
+	c.stmts.stmts[normalized] = c.stmts.lru.PushFront(&pooledStmt{query: normalized, stmt: cacheStmt})
+	for c.stmts.lru.Len() > maxPooledStmts {
+		oldest := c.stmts.lru.Back()
+		pooled := c.stmts.lru.Remove(oldest).(*pooledStmt)
+		delete(c.stmts.stmts, pooled.query)
+		pooled.stmt.Close()
+	}
+	return cacheStmt, nil
+}
+
+// close closes every pooled statement and empties the pool.
+func (p *stmtPool) close() error {
+	var firstErr error
+	for elem := p.lru.Front(); elem != nil; elem = elem.Next() {
+		if err := elem.Value.(*pooledStmt).stmt.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	p.lru.Init()
+	clear(p.stmts)
+	return firstErr
+}
@@ -0,0 +1,268 @@
+package cache
+
+import (
+	"cmp"
+	"context"
+	"database/sql/driver"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"hash/maphash"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// maxAccessLogKeys bounds the number of distinct keys recorded per query
+	maxAccessLogKeys = 10000
+	// accessLogShards is the number of independently locked parts of the access log
+	accessLogShards = 64
+	// warmupWorkers is the number of connections used to fill the caches
+	warmupWorkers = 8
+)
+
+func init() {
+	// query arguments are stored as interface values
+	gob.Register(time.Time{})
+}
+
+// accessEntry is how often a key of a cached query was read, with the arguments to fetch it again
+type accessEntry struct {
+	Args  []driver.Value
+	Count int64
+}
+
+// accessLogShard holds the keys whose hash falls into it, so that concurrent reads rarely share a lock
+type accessLogShard struct {
+	mu      sync.Mutex
+	queries map[string]map[string]*accessEntry // query -> key -> entry
+}
+
+var (
+	accessLog     [accessLogShards]accessLogShard
+	accessLogSeed = maphash.MakeSeed()
+)
+
+func init() {
+	for i := range accessLog {
+		accessLog[i].queries = make(map[string]map[string]*accessEntry)
+	}
+}
+
+func accessLogShardOf(query, key string) *accessLogShard {
+	var h maphash.Hash
+	h.SetSeed(accessLogSeed)
+	h.WriteString(query)
+	h.WriteString(key)
+	return &accessLog[h.Sum64()%accessLogShards]
+}
+
+// keysLocked returns the keys of query in the shard, adding them if needed; mu must be held
+func (s *accessLogShard) keysLocked(query string) map[string]*accessEntry {
+	keys, ok := s.queries[query]
+	if !ok {
+		keys = make(map[string]*accessEntry)
+		s.queries[query] = keys
+	}
+	return keys
+}
+
+func recordAccess(query, key string, args []driver.Value) {
+	shard := accessLogShardOf(query, key)
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+	keys := shard.keysLocked(query)
+	if entry, ok := keys[key]; ok {
+		entry.Count++
+		return
+	}
+	if len(keys) >= maxAccessLogKeys/accessLogShards {
+		return
+	}
+	copied := make([]driver.Value, len(args))
+	for i, arg := range args {
+		copied[i], _ = copyValue(arg)
+	}
+	keys[key] = &accessEntry{Args: copied, Count: 1}
+}
+
+// SaveAccessLog writes the access counts of the cached queries to path,
+// so that the next run can warm up the keys read most often.
+func SaveAccessLog(path string) error {
+	queries := make(map[string]map[string]*accessEntry)
+	for i := range accessLog {
+		shard := &accessLog[i]
+		shard.mu.Lock()
+		for query, entries := range shard.queries {
+			keys, ok := queries[query]
+			if !ok {
+				keys = make(map[string]*accessEntry)
+				queries[query] = keys
+			}
+			for key, entry := range entries {
+				keys[key] = &accessEntry{Args: entry.Args, Count: entry.Count}
+			}
+		}
+		shard.mu.Unlock()
+	}
+
+	err := writeFileAtomic(path, func(f *os.File) error {
+		return gob.NewEncoder(f).Encode(queries)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save access log: %w", err)
+	}
+	return nil
+}
+
+// writeFileAtomic writes a temporary file next to path with write and renames it to path,
+// so that a crash while writing never leaves a truncated file behind.
+func writeFileAtomic(path string, write func(f *os.File) error) error {
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := write(f); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// LoadAccessLog adds the access counts saved by SaveAccessLog.
+// A missing file is not an error.
+func LoadAccessLog(path string) error {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to open access log: %w", err)
+	}
+	defer f.Close()
+
+	var queries map[string]map[string]*accessEntry
+	if err := gob.NewDecoder(f).Decode(&queries); err != nil {
+		return fmt.Errorf("failed to decode access log: %w", err)
+	}
+
+	for query, entries := range queries {
+		for key, entry := range entries {
+			shard := accessLogShardOf(query, key)
+			shard.mu.Lock()
+			keys := shard.keysLocked(query)
+			if e, ok := keys[key]; ok {
+				e.Count += entry.Count
+			} else if len(keys) < maxAccessLogKeys/accessLogShards {
+				keys[key] = entry
+			}
+			shard.mu.Unlock()
+		}
+	}
+	return nil
+}
+
+// hottestArgs returns the arguments of the n most read keys of query.
+func hottestArgs(query string, n int) [][]driver.Value {
+	var entries []accessEntry
+	for i := range accessLog {
+		shard := &accessLog[i]
+		shard.mu.Lock()
+		for _, entry := range shard.queries[query] {
+			entries = append(entries, *entry)
+		}
+		shard.mu.Unlock()
+	}
+
+	slices.SortFunc(entries, func(a, b accessEntry) int {
+		return cmp.Compare(b.Count, a.Count)
+	})
+	args := make([][]driver.Value, 0, min(n, len(entries)))
+	for _, entry := range entries[:min(n, len(entries))] {
+		args = append(args, entry.Args)
+	}
+	return args
+}
+
+type warmupJob struct {
+	cache cacheWithInfo
+	args  []driver.Value
+}
+
+// Warmup fills the queries without conditions (whole-table queries) and
+// the topN most read keys of every other cached query.
+func Warmup(ctx context.Context, topN int) error {
+	connector := primaryConnector.Load()
+	if connector == nil {
+		return fmt.Errorf("warm-up is started before any connection is opened")
+	}
+
+	var jobs []warmupJob
+	for _, cache := range loadPlan().caches {
+		if len(cache.info.Conditions) == 0 {
+			jobs = append(jobs, warmupJob{cache: cache})
+			continue
+		}
+		for _, args := range hottestArgs(cache.query, topN) {
+			jobs = append(jobs, warmupJob{cache: cache, args: args})
+		}
+	}
+
+	conns := make([]driver.Conn, 0, warmupWorkers)
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+	for range warmupWorkers {
+		conn, err := (*connector).Connect(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to connect for warm-up: %w", err)
+		}
+		conns = append(conns, conn)
+	}
+
+	start := time.Now()
+	ch := make(chan warmupJob)
+	var failed atomic.Int64
+	var wg sync.WaitGroup
+	for _, conn := range conns {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			queryer := conn.(driver.QueryerContext)
+			for job := range ch {
+				cacheCtx := context.WithValue(ctx, queryKey{}, job.cache.query)
+				cacheCtx = context.WithValue(cacheCtx, queryerCtxKey{}, queryer)
+				cacheCtx = context.WithValue(cacheCtx, namedValueArgsKey{}, valueToNamedValue(job.args))
+				if _, err := job.cache.get(cacheCtx, job.args); err != nil {
+					failed.Add(1)
+				}
+			}
+		}()
+	}
+	for _, job := range jobs {
+		ch <- job
+	}
+	close(ch)
+	wg.Wait()
+
+	log.Printf("cache warm-up: %d keys in %s", len(jobs), time.Since(start))
+	if n := failed.Load(); n > 0 {
+		return fmt.Errorf("failed to warm up %d keys", n)
+	}
+	return nil
+}
@@ -0,0 +1,399 @@
+package cache
+
+import (
+	"context"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// writeBehindBatchSize is the number of queued rows that triggers a flush
+	writeBehindBatchSize = 500
+	// writeBehindInterval is the longest time a row stays in the queue
+	writeBehindInterval = 100 * time.Millisecond
+	// writeBehindMaxRetryInterval caps the backoff between flushes of a failing queue
+	writeBehindMaxRetryInterval = 5 * time.Second
+	// writeBehindMaxPending is the number of queued rows at which inserts are no longer acknowledged
+	// before reaching MySQL: they flush the queue themselves, and fail if it cannot be flushed
+	writeBehindMaxPending = 50000
+)
+
+// writeBehindQueue buffers the rows inserted into one table with one column list.
+// Rows get their id from the driver, so they can be acknowledged before reaching MySQL.
+type writeBehindQueue struct {
+	table   string
+	columns []string
+	// mentions matches queries that read or write the table
+	mentions *regexp.Regexp
+
+	mu       sync.Mutex
+	rows     []row
+	failures int
+	pending  atomic.Int64
+	// retryAt is when the flusher retries a failing queue (unix nanoseconds), 0 if it is not failing
+	retryAt atomic.Int64
+}
+
+// writeBehindIDs allocates ids per table; all queues of a table share it
+type writeBehindIDs struct {
+	mu     sync.Mutex
+	loaded bool
+	nextID int64
+}
+
+var writeBehind = struct {
+	mu     sync.Mutex
+	queues map[string]*writeBehindQueue // table + columns -> queue
+	ids    map[string]*writeBehindIDs   // table -> ids
+	once   sync.Once
+	notify chan struct{}
+
+	// connMu guards conn, the dedicated connection used for flushing
+	connMu sync.Mutex
+	conn   driver.Conn
+}{
+	queues: make(map[string]*writeBehindQueue),
+	ids:    make(map[string]*writeBehindIDs),
+	notify: make(chan struct{}, 1),
+}
+
+// pendingWrite is a write-behind insert made in a transaction, queued on commit
+type pendingWrite struct {
+	queue *writeBehindQueue
+	rows  []row
+}
+
+type writeBehindResult struct {
+	lastInsertID int64
+	rowsAffected int64
+}
+
+func (r writeBehindResult) LastInsertId() (int64, error) { return r.lastInsertID, nil }
+func (r writeBehindResult) RowsAffected() (int64, error) { return r.rowsAffected, nil }
+
+func writeBehindQueueFor(table string, columns []string) *writeBehindQueue {
+	key := table + "\x00" + strings.Join(columns, ",")
+
+	writeBehind.mu.Lock()
+	defer writeBehind.mu.Unlock()
+	if q, ok := writeBehind.queues[key]; ok {
+		return q
+	}
+	q := &writeBehindQueue{
+		table:    table,
+		columns:  slices.Clone(columns),
+		mentions: regexp.MustCompile(`\b` + regexp.QuoteMeta(table) + `\b`),
+	}
+	writeBehind.queues[key] = q
+	if _, ok := writeBehind.ids[table]; !ok {
+		writeBehind.ids[table] = &writeBehindIDs{}
+	}
+	writeBehind.once.Do(func() { go runWriteBehindFlusher() })
+	return q
+}
+
+// allocateIDs reserves n ids for the table and returns the first one.
+func allocateIDs(ctx context.Context, table string, n int) (int64, error) {
+	writeBehind.mu.Lock()
+	ids := writeBehind.ids[table]
+	writeBehind.mu.Unlock()
+
+	ids.mu.Lock()
+	defer ids.mu.Unlock()
+	if !ids.loaded {
+		maxID, err := queryMaxID(ctx, table)
+		if err != nil {
+			return 0, err
+		}
+		ids.nextID = maxID + 1
+		ids.loaded = true
+	}
+	first := ids.nextID
+	ids.nextID += int64(n)
+	return first, nil
+}
+
+// resetWriteBehindIDs makes every table allocate ids from its MAX(id) again.
+func resetWriteBehindIDs() {
+	writeBehind.mu.Lock()
+	defer writeBehind.mu.Unlock()
+	for _, ids := range writeBehind.ids {
+		ids.mu.Lock()
+		ids.loaded = false
+		ids.mu.Unlock()
+	}
+}
+
+func queryMaxID(ctx context.Context, table string) (int64, error) {
+	writeBehind.connMu.Lock()
+	defer writeBehind.connMu.Unlock()
+	conn, err := writeBehindConn(ctx)
+	if err != nil {
+		return 0, err
+	}
+	rows, err := conn.(driver.QueryerContext).QueryContext(ctx, fmt.Sprintf("SELECT IFNULL(MAX(id), 0) FROM %s", table), nil)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+	dest := make([]driver.Value, 1)
+	if err := rows.Next(dest); err != nil {
+		return 0, err
+	}
+	switch v := dest[0].(type) {
+	case int64:
+		return v, nil
+	case []byte:
+		var id int64
+		_, err := fmt.Sscan(string(v), &id)
+		return id, err
+	default:
+		return 0, fmt.Errorf("unexpected type of MAX(id): %T", v)
+	}
+}
+
+// writeBehindConn returns the flushing connection, opening it on first use.
+// connMu must be held.
+func writeBehindConn(ctx context.Context) (driver.Conn, error) {
+	if writeBehind.conn != nil {
+		return writeBehind.conn, nil
+	}
+	connector := primaryConnector.Load()
+	if connector == nil {
+		return nil, fmt.Errorf("write-behind is used before any connection is opened")
+	}
+	conn, err := (*connector).Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	writeBehind.conn = conn
+	return conn, nil
+}
+
+// resetWriteBehindConn closes the flushing connection so that the next flush opens a new one.
+func resetWriteBehindConn() {
+	writeBehind.connMu.Lock()
+	defer writeBehind.connMu.Unlock()
+	if writeBehind.conn != nil {
+		writeBehind.conn.Close()
+		writeBehind.conn = nil
+	}
+}
+
+// newWriteBehindRows assigns ids to the inserted rows.
+func newWriteBehindRows(ctx context.Context, q *writeBehindQueue, args []driver.Value) ([]row, writeBehindResult, error) {
+	chunks := slices.Collect(slices.Chunk(args, len(q.columns)))
+	firstID, err := allocateIDs(ctx, q.table, len(chunks))
+	if err != nil {
+		return nil, writeBehindResult{}, err
+	}
+	rows := make([]row, len(chunks))
+	for i, chunk := range chunks {
+		r := make(row, 0, len(chunk)+1)
+		r = append(r, firstID+int64(i))
+		for _, v := range chunk {
+			copied, _ := copyValue(v)
+			r = append(r, copied)
+		}
+		rows[i] = r
+	}
+	return rows, writeBehindResult{lastInsertID: firstID, rowsAffected: int64(len(rows))}, nil
+}
+
+func (q *writeBehindQueue) enqueue(rows []row) {
+	q.mu.Lock()
+	q.rows = append(q.rows, rows...)
+	n := len(q.rows)
+	q.pending.Store(int64(n))
+	q.mu.Unlock()
+
+	if n >= writeBehindBatchSize {
+		select {
+		case writeBehind.notify <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// flush writes the queued rows to MySQL as multi-row inserts.
+// A failing batch stays at the head of the queue, and the flusher retries it with backoff;
+// the rows have been acknowledged, so they are never dropped.
+func (q *writeBehindQueue) flush(ctx context.Context) error {
+	writeBehind.connMu.Lock()
+	defer writeBehind.connMu.Unlock()
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for len(q.rows) > 0 {
+		batch := q.rows[:min(len(q.rows), writeBehindBatchSize)]
+		if err := q.insertBatch(ctx, batch); err != nil {
+			q.failures++
+			backoff := min(writeBehindInterval<<min(q.failures, 16), writeBehindMaxRetryInterval)
+			q.retryAt.Store(time.Now().Add(backoff).UnixNano())
+			return err
+		}
+		q.failures = 0
+		q.retryAt.Store(0)
+		q.rows = q.rows[len(batch):]
+		q.pending.Store(int64(len(q.rows)))
+	}
+	q.rows = nil
+	return nil
+}
+
+// backingOff reports whether the flusher should wait before retrying the queue.
+func (q *writeBehindQueue) backingOff(now time.Time) bool {
+	return now.UnixNano() < q.retryAt.Load()
+}
+
+// insertBatch must be called with connMu held
+func (q *writeBehindQueue) insertBatch(ctx context.Context, batch []row) error {
+	conn, err := writeBehindConn(ctx)
+	if err != nil {
+		return err
+	}
+	err = insertWriteBehindRows(ctx, conn.(driver.ExecerContext), q.table, q.columns, batch)
+	if errors.Is(err, driver.ErrBadConn) {
+		writeBehind.conn.Close()
+		writeBehind.conn = nil
+	}
+	return err
+}
+
+// insertWriteBehindRows inserts the rows, led by their ids, with one multi-row insert.
+func insertWriteBehindRows(ctx context.Context, conn driver.ExecerContext, table string, columns []string, rows []row) error {
+	placeholder := "(?" + strings.Repeat(", ?", len(columns)) + ")"
+	var query strings.Builder
+	fmt.Fprintf(&query, "INSERT INTO %s (id, %s) VALUES ", table, strings.Join(columns, ", "))
+	args := make([]driver.NamedValue, 0, len(rows)*(len(columns)+1))
+	for i, r := range rows {
+		if i > 0 {
+			query.WriteString(", ")
+		}
+		query.WriteString(placeholder)
+		for _, v := range r {
+			args = append(args, driver.NamedValue{Ordinal: len(args) + 1, Value: v})
+		}
+	}
+	_, err := conn.ExecContext(ctx, query.String(), args)
+	return err
+}
+
+func writeBehindQueues() []*writeBehindQueue {
+	writeBehind.mu.Lock()
+	defer writeBehind.mu.Unlock()
+	queues := make([]*writeBehindQueue, 0, len(writeBehind.queues))
+	for _, q := range writeBehind.queues {
+		queues = append(queues, q)
+	}
+	return queues
+}
+
+func runWriteBehindFlusher() {
+	ticker := time.NewTicker(writeBehindInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-writeBehind.notify:
+		}
+		now := time.Now()
+		for _, q := range writeBehindQueues() {
+			if q.pending.Load() == 0 || q.backingOff(now) {
+				continue
+			}
+			if err := q.flush(context.Background()); err != nil {
+				log.Printf("write-behind: failed to flush %s (%d rows queued), retrying: %v", q.table, q.pending.Load(), err)
+			}
+		}
+	}
+}
+
+// flushWriteBehindFor flushes the queued rows of every table the query refers to,
+// so that the query observes the inserts acknowledged so far.
+func flushWriteBehindFor(ctx context.Context, query string) error {
+	for _, q := range writeBehindQueues() {
+		if q.pending.Load() == 0 || !q.mentions.MatchString(query) {
+			continue
+		}
+		if err := q.flush(ctx); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// FlushWriteBehind writes every queued insert to MySQL.
+// It should be called on shutdown so that acknowledged inserts are not lost.
+func FlushWriteBehind(ctx context.Context) error {
+	var firstErr error
+	for _, q := range writeBehindQueues() {
+		if err := q.flush(ctx); err != nil && firstErr == nil {
+			firstErr = fmt.Errorf("failed to flush %s: %w", q.table, err)
+		}
+	}
+	return firstErr
+}
+
+func (c *cacheConn) execWriteBehind(ctx context.Context, table string, columns []string, args []driver.Value) (driver.Result, error) {
+	q := writeBehindQueueFor(table, columns)
+	if q.pending.Load() >= writeBehindMaxPending {
+		// MySQL is not keeping up; make the caller wait for it instead of queueing rows without bound
+		if err := q.flush(ctx); err != nil {
+			return nil, fmt.Errorf("write-behind queue of %s is full: %w", table, err)
+		}
+	}
+	rows, res, err := newWriteBehindRows(ctx, q, args)
+	if err != nil {
+		return nil, err
+	}
+	if c.tx {
+		// queued on commit, dropped on rollback
+		c.pendingWrites = append(c.pendingWrites, pendingWrite{queue: q, rows: rows})
+		return res, nil
+	}
+	q.enqueue(rows)
+	return res, nil
+}
+
+// flushPendingWritesFor inserts the write-behind rows of the ongoing transaction into the tables
+// the query refers to, within the transaction, so that the query observes them.
+func (c *cacheConn) flushPendingWritesFor(ctx context.Context, query string) error {
+	if !c.tx || len(c.pendingWrites) == 0 {
+		return nil
+	}
+	kept := make([]pendingWrite, 0, len(c.pendingWrites))
+	defer func() { c.pendingWrites = kept }()
+	for i, w := range c.pendingWrites {
+		if !w.queue.mentions.MatchString(query) {
+			kept = append(kept, w)
+			continue
+		}
+		for len(w.rows) > 0 {
+			batch := w.rows[:min(len(w.rows), writeBehindBatchSize)]
+			if err := insertWriteBehindRows(ctx, c.inner.(driver.ExecerContext), w.queue.table, w.queue.columns, batch); err != nil {
+				// keep the rows not inserted yet, so that they are neither lost nor inserted twice
+				kept = append(kept, w)
+				kept = append(kept, c.pendingWrites[i+1:]...)
+				return err
+			}
+			w.rows = w.rows[len(batch):]
+		}
+	}
+	return nil
+}
+
+func (c *cacheConn) commitPendingWrites() {
+	for _, w := range c.pendingWrites {
+		w.queue.enqueue(w.rows)
+	}
+	c.pendingWrites = c.pendingWrites[:0]
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 再接続時に再送できるよう、配信ごとに直近のイベントを残しておく件数
+	eventHubBacklog = 256
+	// 購読者ごとの送信待ちイベントの上限。溢れた購読者は切断し、再接続で追いついてもらう
+	eventHubSubscriberBuffer = 64
+)
+
+// hubEvent は配信ごとに採番されたイベント
+type hubEvent struct {
+	ID   hubEventID
+	Type string
+	Data []byte
+}
+
+// hubEventID は "エポック-連番" の形でクライアントに渡す。
+// 連番は起動と初期化のたびに1からやり直すので、エポックが違うIDからは再送しない
+type hubEventID struct {
+	Epoch int64
+	Seq   int64
+}
+
+func (id hubEventID) String() string {
+	return fmt.Sprintf("%d-%d", id.Epoch, id.Seq)
+}
+
+func parseHubEventID(s string) (hubEventID, error) {
+	epoch, seq, ok := strings.Cut(s, "-")
+	if !ok {
+		return hubEventID{}, fmt.Errorf("invalid event id: %q", s)
+	}
+	var id hubEventID
+	var err error
+	if id.Epoch, err = strconv.ParseInt(epoch, 10, 64); err != nil {
+		return hubEventID{}, err
+	}
+	if id.Seq, err = strconv.ParseInt(seq, 10, 64); err != nil {
+		return hubEventID{}, err
+	}
+	return id, nil
+}
+
+// eventHub はプロセス内で配信ごとのイベントを購読者に配る
+type eventHub struct {
+	mu     sync.Mutex
+	topics map[int64]*hubTopic
+	// 起動時刻から始め、初期化のたびに進める
+	epoch  int64
+	closed bool
+}
+
+type hubTopic struct {
+	lastID      int64
+	recent      []hubEvent
+	subscribers map[*hubSubscriber]struct{}
+}
+
+type hubSubscriber struct {
+	// 遅すぎる購読者と終了時にはcloseされる
+	ch chan hubEvent
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{topics: make(map[int64]*hubTopic), epoch: time.Now().UnixNano()}
+}
+
+// topicLocked はmuを取った状態で呼ぶ
+func (h *eventHub) topicLocked(topicID int64) *hubTopic {
+	t, ok := h.topics[topicID]
+	if !ok {
+		t = &hubTopic{subscribers: make(map[*hubSubscriber]struct{})}
+		h.topics[topicID] = t
+	}
+	return t
+}
+
+func (h *eventHub) publish(topicID int64, typ string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.closed {
+		return nil
+	}
+	t := h.topicLocked(topicID)
+	t.lastID++
+	ev := hubEvent{ID: hubEventID{Epoch: h.epoch, Seq: t.lastID}, Type: typ, Data: data}
+	t.recent = append(t.recent, ev)
+	if len(t.recent) > eventHubBacklog {
+		t.recent = t.recent[len(t.recent)-eventHubBacklog:]
+	}
+	for sub := range t.subscribers {
+		select {
+		case sub.ch <- ev:
+		default:
+			// 詰まっている購読者のせいで投稿を止めないよう切断する
+			close(sub.ch)
+			delete(t.subscribers, sub)
+		}
+	}
+	return nil
+}
+
+// subscribe はlastIDより後のイベントを購読する。
+// 再送すべきイベントが残っていなければcompleteはfalseになり、購読者は一覧を取り直す必要がある
+func (h *eventHub) subscribe(topicID int64, lastID hubEventID) (sub *hubSubscriber, replay []hubEvent, complete bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sub = &hubSubscriber{ch: make(chan hubEvent, eventHubSubscriberBuffer)}
+	if h.closed {
+		close(sub.ch)
+		return sub, nil, true
+	}
+	t := h.topicLocked(topicID)
+	t.subscribers[sub] = struct{}{}
+
+	if lastID == (hubEventID{}) {
+		return sub, nil, true
+	}
+	if lastID.Epoch != h.epoch || lastID.Seq > t.lastID {
+		// 再起動や初期化より前のID
+		return sub, nil, false
+	}
+	for _, ev := range t.recent {
+		if ev.ID.Seq > lastID.Seq {
+			replay = append(replay, ev)
+		}
+	}
+	complete = len(replay) == 0 || replay[0].ID.Seq == lastID.Seq+1
+	return sub, replay, complete
+}
+
+func (h *eventHub) unsubscribe(topicID int64, sub *hubSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	t, ok := h.topics[topicID]
+	if !ok {
+		return
+	}
+	if _, ok := t.subscribers[sub]; ok {
+		close(sub.ch)
+		delete(t.subscribers, sub)
+	}
+}
+
+func (h *eventHub) isClosed() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.closed
+}
+
+// reset は初期化時に履歴を捨て、購読者を切断する
+func (h *eventHub) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.disconnectLocked()
+	clear(h.topics)
+	h.epoch = max(time.Now().UnixNano(), h.epoch+1)
+}
+
+// close は終了時に購読者を切断し、以降のイベントを捨てる
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.disconnectLocked()
+	h.closed = true
+}
+
+func (h *eventHub) disconnectLocked() {
+	for _, t := range h.topics {
+		for sub := range t.subscribers {
+			close(sub.ch)
+		}
+		clear(t.subscribers)
+	}
+}
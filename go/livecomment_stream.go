@@ -0,0 +1,114 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// SSEのコメントだけの行を送る間隔。プロキシにアイドル接続として切られないようにする
+const sseHeartbeatInterval = 15 * time.Second
+
+const (
+	livecommentEventPosted  = "livecomment"
+	livecommentEventDeleted = "livecomment_deleted"
+	// 再送しきれないときに送る。クライアントはポーリングAPIで一覧を取り直す
+	livecommentEventReset = "reset"
+)
+
+var livecommentEvents = newEventHub()
+
+type LivecommentDeletedEvent struct {
+	ID           int64 `json:"id"`
+	LivestreamID int64 `json:"livestream_id"`
+}
+
+func streamLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var lastEventID hubEventID
+	if v := c.Request().Header.Get("Last-Event-ID"); v != "" {
+		lastEventID, err = parseHubEventID(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, "Last-Event-ID header must be an event id")
+		}
+	}
+
+	var livestreamModel LivestreamModel
+	if err := dbConn.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	sub, replay, complete := livecommentEvents.subscribe(livestreamModel.ID, lastEventID)
+	defer livecommentEvents.unsubscribe(livestreamModel.ID, sub)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set(echo.HeaderCacheControl, "no-cache")
+	res.Header().Set(echo.HeaderConnection, "keep-alive")
+	// nginxにバッファリングさせない
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+
+	if !complete {
+		if err := writeSSEEvent(res, hubEvent{Type: livecommentEventReset, Data: []byte("{}")}); err != nil {
+			return nil
+		}
+	}
+	for _, ev := range replay {
+		if err := writeSSEEvent(res, ev); err != nil {
+			return nil
+		}
+	}
+	res.Flush()
+
+	ticker := time.NewTicker(sseHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-sub.ch:
+			if !ok {
+				// 遅すぎるか終了処理中。クライアントはLast-Event-IDで再接続する
+				return nil
+			}
+			if err := writeSSEEvent(res, ev); err != nil {
+				return nil
+			}
+		case <-ticker.C:
+			if _, err := fmt.Fprint(res, ": ping\n\n"); err != nil {
+				return nil
+			}
+		}
+		res.Flush()
+	}
+}
+
+func writeSSEEvent(res *echo.Response, ev hubEvent) error {
+	if ev.ID.Seq > 0 {
+		if _, err := fmt.Fprintf(res, "id: %s\n", ev.ID); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", ev.Type, ev.Data)
+	return err
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 配信者から招待され、まだ承諾していない
+	cohostStatusInvited = "invited"
+	// 承諾した。配信のモデレーションができる
+	cohostStatusAccepted = "accepted"
+)
+
+type LivestreamCohostModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	UserID       int64  `db:"user_id"`
+	Status       string `db:"status"`
+	CreatedAt    int64  `db:"created_at"`
+}
+
+type LivestreamCohost struct {
+	User      User   `json:"user"`
+	Status    string `json:"status"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type InviteCohostRequest struct {
+	UserID int64 `json:"user_id"`
+}
+
+func getLivestreamCohostModels(ctx context.Context, tx *sqlx.Tx, livestreamID int64) ([]LivestreamCohostModel, error) {
+	var cohostModels []LivestreamCohostModel
+	if err := tx.SelectContext(ctx, &cohostModels, "SELECT * FROM livestream_cohosts WHERE livestream_id = ?", livestreamID); err != nil {
+		return nil, err
+	}
+	return cohostModels, nil
+}
+
+// getAcceptedCohosts は配信ごとの承諾済みのコラボレーターを、一覧の配信全体でまとめて引く。
+// 複数の配信のコラボレーターになっているユーザも一度だけ埋める
+func getAcceptedCohosts(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64) (map[int64][]User, error) {
+	cohosts := make(map[int64][]User, len(livestreamIDs))
+	if len(livestreamIDs) == 0 {
+		return cohosts, nil
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM livestream_cohosts WHERE livestream_id IN (?)", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	var cohostModels []LivestreamCohostModel
+	if err := tx.SelectContext(ctx, &cohostModels, query, args...); err != nil {
+		return nil, err
+	}
+
+	var userIDs []int64
+	seen := make(map[int64]struct{})
+	for _, cohostModel := range cohostModels {
+		if cohostModel.Status != cohostStatusAccepted {
+			continue
+		}
+		if _, ok := seen[cohostModel.UserID]; !ok {
+			seen[cohostModel.UserID] = struct{}{}
+			userIDs = append(userIDs, cohostModel.UserID)
+		}
+	}
+	if len(userIDs) == 0 {
+		return cohosts, nil
+	}
+
+	// usersはトランザクションの中でもレプリカから返る
+	query, args, err = sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
+	if err != nil {
+		return nil, err
+	}
+	var userModels []UserModel
+	if err := tx.SelectContext(ctx, &userModels, query, args...); err != nil {
+		return nil, err
+	}
+	users := make(map[int64]User, len(userModels))
+	for _, userModel := range userModels {
+		user, err := fillUserResponse(ctx, tx, userModel)
+		if err != nil {
+			return nil, err
+		}
+		users[userModel.ID] = user
+	}
+
+	for _, cohostModel := range cohostModels {
+		if cohostModel.Status != cohostStatusAccepted {
+			continue
+		}
+		user, ok := users[cohostModel.UserID]
+		if !ok {
+			return nil, sql.ErrNoRows
+		}
+		cohosts[cohostModel.LivestreamID] = append(cohosts[cohostModel.LivestreamID], user)
+	}
+	return cohosts, nil
+}
+
+// canModerateLivestream は配信者本人か、承諾済みのコラボレーターならtrueを返す
+func canModerateLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID int64) (bool, error) {
+	if livestreamModel.UserID == userID {
+		return true, nil
+	}
+	cohostModels, err := getLivestreamCohostModels(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return false, err
+	}
+	for _, cohostModel := range cohostModels {
+		if cohostModel.UserID == userID && cohostModel.Status == cohostStatusAccepted {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// inviteCohosts は配信にコラボレーターを招待する。招待済みのユーザは飛ばす
+func inviteCohosts(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userIDs []int64) ([]LivestreamCohostModel, error) {
+	cohostModels, err := getLivestreamCohostModels(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream cohosts: "+err.Error())
+	}
+	invited := make(map[int64]struct{}, len(cohostModels))
+	for _, cohostModel := range cohostModels {
+		invited[cohostModel.UserID] = struct{}{}
+	}
+
+	var newCohostModels []LivestreamCohostModel
+	for _, userID := range userIDs {
+		if userID == livestreamModel.UserID {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "a streamer can't invite themselves as a collaborator")
+		}
+		if _, ok := invited[userID]; ok {
+			continue
+		}
+		var userModel UserModel
+		if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, echo.NewHTTPError(http.StatusBadRequest, "collaborator not found: "+strconv.FormatInt(userID, 10))
+			}
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+
+		cohostModel := LivestreamCohostModel{
+			LivestreamID: livestreamModel.ID,
+			UserID:       userID,
+			Status:       cohostStatusInvited,
+			CreatedAt:    time.Now().Unix(),
+		}
+		rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_cohosts (livestream_id, user_id, status, created_at) VALUES (:livestream_id, :user_id, :status, :created_at)", cohostModel)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream cohost: "+err.Error())
+		}
+		if cohostModel.ID, err = rs.LastInsertId(); err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream cohost id: "+err.Error())
+		}
+		invited[userID] = struct{}{}
+		newCohostModels = append(newCohostModels, cohostModel)
+	}
+	return newCohostModels, nil
+}
+
+// getLivestreamCohostsHandler は招待中を含むコラボレーターの一覧を返す。配信者とコラボレーター本人だけが見られる
+func getLivestreamCohostsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	cohostModels, err := getLivestreamCohostModels(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream cohosts: "+err.Error())
+	}
+
+	visible := livestreamModel.UserID == userID
+	for _, cohostModel := range cohostModels {
+		if cohostModel.UserID == userID {
+			visible = true
+		}
+	}
+	if !visible {
+		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's collaborators")
+	}
+
+	cohosts := make([]LivestreamCohost, len(cohostModels))
+	for i := range cohostModels {
+		cohost, err := fillLivestreamCohostResponse(ctx, tx, cohostModels[i])
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream cohost: "+err.Error())
+		}
+		cohosts[i] = cohost
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, cohosts)
+}
+
+func inviteLivestreamCohostHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *InviteCohostRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+	newCohostModels, err := inviteCohosts(ctx, tx, livestreamModel, []int64{req.UserID})
+	if err != nil {
+		return err
+	}
+	if len(newCohostModels) == 0 {
+		return echo.NewHTTPError(http.StatusConflict, "the user is already invited")
+	}
+
+	cohost, err := fillLivestreamCohostResponse(ctx, tx, newCohostModels[0])
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream cohost: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, cohost)
+}
+
+// acceptLivestreamCohostHandler は自分宛ての招待を承諾する
+func acceptLivestreamCohostHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := lockLivestream(ctx, tx, int64(livestreamID))
+	if err != nil {
+		return err
+	}
+	cohostModels, err := getLivestreamCohostModels(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream cohosts: "+err.Error())
+	}
+	var cohostModel *LivestreamCohostModel
+	for i := range cohostModels {
+		if cohostModels[i].UserID == userID {
+			cohostModel = &cohostModels[i]
+		}
+	}
+	if cohostModel == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "not invited to the livestream")
+	}
+	if cohostModel.Status != cohostStatusAccepted {
+		if _, err := tx.ExecContext(ctx, "UPDATE livestream_cohosts SET status = ? WHERE id = ?", cohostStatusAccepted, cohostModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream cohost: "+err.Error())
+		}
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// removeLivestreamCohostHandler は配信者がコラボレーターを外すか、招待されたユーザ自身が辞退する
+func removeLivestreamCohostHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+	cohostUserID, err := strconv.ParseInt(c.Param("user_id"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "user_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := lockLivestream(ctx, tx, int64(livestreamID))
+	if err != nil {
+		return err
+	}
+	if livestreamModel.UserID != userID && cohostUserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't remove other streamer's collaborators")
+	}
+	cohostModels, err := getLivestreamCohostModels(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream cohosts: "+err.Error())
+	}
+	var cohostModel *LivestreamCohostModel
+	for i := range cohostModels {
+		if cohostModels[i].UserID == cohostUserID {
+			cohostModel = &cohostModels[i]
+		}
+	}
+	if cohostModel == nil {
+		return echo.NewHTTPError(http.StatusNotFound, "the user is not a collaborator of the livestream")
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_cohosts WHERE id = ?", cohostModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream cohost: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// getCohostInvitationsHandler はまだ承諾していない自分宛ての招待を配信の一覧で返す
+func getCohostInvitationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT l.* FROM livestreams l INNER JOIN livestream_cohosts h ON h.livestream_id = l.id WHERE h.user_id = ? AND h.status = ? ORDER BY l.start_at", userID, cohostStatusInvited); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreams)
+}
+
+func fillLivestreamCohostResponse(ctx context.Context, tx *sqlx.Tx, cohostModel LivestreamCohostModel) (LivestreamCohost, error) {
+	userModel := UserModel{}
+	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", cohostModel.UserID); err != nil {
+		return LivestreamCohost{}, err
+	}
+	user, err := fillUserResponse(ctx, tx, userModel)
+	if err != nil {
+		return LivestreamCohost{}, err
+	}
+	return LivestreamCohost{
+		User:      user,
+		Status:    cohostModel.Status,
+		CreatedAt: cohostModel.CreatedAt,
+	}, nil
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"database/sql"
+	"errors"
+	"maps"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	livestreamSortNewest        = "newest"
+	livestreamSortStartingSoon  = "starting_soon"
+	livestreamSortMostReactions = "most_reactions"
+
+	// 索引はプロセスごとに持つので、他のプロセスでの書き込みはこの間隔での作り直しで取り込む
+	livestreamIndexRebuildInterval = time.Minute
+)
+
+// livestreamSearch は /api/livestream/search のクエリ
+type livestreamSearch struct {
+	// タイトルか説明文に全て含まれるキーワード
+	keywords []string
+	tagNames []string
+	// trueなら全てのタグ、falseならいずれかのタグが付いた配信
+	allTags bool
+	owner   string
+	// 0は指定なし。いずれも境界を含む
+	startAtFrom, startAtTo int64
+	endAtFrom, endAtTo     int64
+	sort                   string
+	statuses               statusFilter
+}
+
+func parseLivestreamSearch(c echo.Context) (livestreamSearch, error) {
+	s := livestreamSearch{
+		keywords: strings.Fields(strings.ToLower(c.QueryParam("q"))),
+		owner:    c.QueryParam("owner"),
+		sort:     livestreamSortNewest,
+	}
+	// tag=a&tag=b と tag=a,b のどちらでも指定できる
+	for _, v := range c.QueryParams()["tag"] {
+		for _, name := range strings.Split(v, ",") {
+			if name != "" {
+				s.tagNames = append(s.tagNames, name)
+			}
+		}
+	}
+	statuses, err := parseStatusFilter(c)
+	if err != nil {
+		return s, err
+	}
+	s.statuses = statuses
+	switch c.QueryParam("tag_mode") {
+	case "", "or":
+	case "and":
+		s.allTags = true
+	default:
+		return s, echo.NewHTTPError(http.StatusBadRequest, "tag_mode query parameter must be and or or")
+	}
+	switch v := c.QueryParam("sort"); v {
+	case "":
+	case livestreamSortNewest, livestreamSortStartingSoon, livestreamSortMostReactions:
+		s.sort = v
+	default:
+		return s, echo.NewHTTPError(http.StatusBadRequest, "sort query parameter must be newest, starting_soon or most_reactions")
+	}
+	for name, dst := range map[string]*int64{
+		"start_at_from": &s.startAtFrom,
+		"start_at_to":   &s.startAtTo,
+		"end_at_from":   &s.endAtFrom,
+		"end_at_to":     &s.endAtTo,
+	} {
+		if v := c.QueryParam(name); v != "" {
+			t, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return s, echo.NewHTTPError(http.StatusBadRequest, name+" query parameter must be integer")
+			}
+			*dst = t
+		}
+	}
+	return s, nil
+}
+
+var livestreamIndex = newLivestreamSearchIndex()
+
+// livestreamSearchIndex はプロセス内の配信の転置インデックス。初回の検索時にDBから作り、
+// 以降はこのプロセスでコミットした変更を反映しながら、livestreamIndexRebuildIntervalごとに作り直す
+type livestreamSearchIndex struct {
+	mu       sync.RWMutex
+	loaded   bool
+	loadedAt time.Time
+
+	livestreams map[int64]*indexedLivestream
+	// タイトルと説明文の文字bigramごとの配信。日本語は単語に区切れないのでbigramにする
+	bigrams map[string]map[int64]struct{}
+	tags    map[int64]map[int64]struct{}
+	owners  map[int64]map[int64]struct{}
+
+	// 読み込み時の時刻からreactionCountWindowだけ遡った時刻。これより前のリアクションは読み込み時に数えている
+	reactionsWindowStart int64
+	// 読み込み時に数えたリアクションのうち、reactionsWindowStart以降に作られたもののID
+	countedReactions map[int64]struct{}
+}
+
+type indexedLivestream struct {
+	model LivestreamModel
+	// 小文字にしたタイトルと説明文
+	text   string
+	tagIDs map[int64]struct{}
+	// 配信者の操作で決まった状態。なければ空文字列
+	state     string
+	reactions int64
+}
+
+func newLivestreamSearchIndex() *livestreamSearchIndex {
+	idx := &livestreamSearchIndex{}
+	idx.clearLocked()
+	return idx
+}
+
+func (idx *livestreamSearchIndex) clearLocked() {
+	idx.loaded = false
+	idx.livestreams = make(map[int64]*indexedLivestream)
+	idx.bigrams = make(map[string]map[int64]struct{})
+	idx.tags = make(map[int64]map[int64]struct{})
+	idx.owners = make(map[int64]map[int64]struct{})
+	idx.countedReactions = make(map[int64]struct{})
+}
+
+// reset は初期化時に呼び、次の検索で作り直させる
+func (idx *livestreamSearchIndex) reset() {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.clearLocked()
+}
+
+func (idx *livestreamSearchIndex) ensureLoaded(ctx context.Context) error {
+	idx.mu.RLock()
+	fresh := idx.loaded && time.Since(idx.loadedAt) < livestreamIndexRebuildInterval
+	idx.mu.RUnlock()
+	if fresh {
+		return nil
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.loaded && time.Since(idx.loadedAt) < livestreamIndexRebuildInterval {
+		return nil
+	}
+	idx.clearLocked()
+	loadedAt := time.Now()
+
+	var livestreamModels []LivestreamModel
+	if err := dbConn.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams"); err != nil {
+		return err
+	}
+	for _, livestreamModel := range livestreamModels {
+		idx.addLocked(livestreamModel, nil)
+	}
+
+	var stateModels []LivestreamStateModel
+	if err := dbConn.SelectContext(ctx, &stateModels, "SELECT * FROM livestream_states"); err != nil {
+		return err
+	}
+	for _, stateModel := range stateModels {
+		if ls, ok := idx.livestreams[stateModel.LivestreamID]; ok {
+			ls.state = stateModel.Status
+		}
+	}
+
+	var livestreamTagModels []LivestreamTagModel
+	if err := dbConn.SelectContext(ctx, &livestreamTagModels, "SELECT * FROM livestream_tags"); err != nil {
+		return err
+	}
+	for _, livestreamTagModel := range livestreamTagModels {
+		idx.addTagLocked(livestreamTagModel.LivestreamID, livestreamTagModel.TagID)
+	}
+
+	// 読み込み後に届いたリアクションだけを足すため、最近のリアクションは1件ずつ取って数えたIDを覚える (reactionCounterと同じ)
+	windowStart := loadedAt.Unix() - reactionCountWindow
+	var reactionCounts []struct {
+		LivestreamID int64 `db:"livestream_id"`
+		Count        int64 `db:"count"`
+	}
+	if err := dbConn.SelectContext(ctx, &reactionCounts, "SELECT livestream_id, COUNT(*) AS count FROM reactions WHERE created_at < ? GROUP BY livestream_id", windowStart); err != nil {
+		return err
+	}
+	for _, rc := range reactionCounts {
+		if ls, ok := idx.livestreams[rc.LivestreamID]; ok {
+			ls.reactions = rc.Count
+		}
+	}
+	var recentReactions []struct {
+		ID           int64 `db:"id"`
+		LivestreamID int64 `db:"livestream_id"`
+	}
+	if err := dbConn.SelectContext(ctx, &recentReactions, "SELECT id, livestream_id FROM reactions WHERE created_at >= ?", windowStart); err != nil {
+		return err
+	}
+	for _, r := range recentReactions {
+		if ls, ok := idx.livestreams[r.LivestreamID]; ok {
+			ls.reactions++
+		}
+		idx.countedReactions[r.ID] = struct{}{}
+	}
+	idx.reactionsWindowStart = windowStart
+
+	idx.loaded = true
+	idx.loadedAt = loadedAt
+	return nil
+}
+
+// add はコミット済みの配信とタグを索引に加える。読み込み前なら何もしない (読み込み時に入る)
+func (idx *livestreamSearchIndex) add(livestreamModel LivestreamModel, tagIDs []int64) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.loaded {
+		idx.addLocked(livestreamModel, tagIDs)
+	}
+}
+
+// addLocked は同じ配信を何度加えても結果が変わらないようにする。
+// 索引済みの配信のタグはtagIDsがnilなら残し、nilでなければtagIDsに入れ替える
+func (idx *livestreamSearchIndex) addLocked(livestreamModel LivestreamModel, tagIDs []int64) {
+	ls, ok := idx.livestreams[livestreamModel.ID]
+	if !ok {
+		ls = &indexedLivestream{tagIDs: make(map[int64]struct{})}
+		idx.livestreams[livestreamModel.ID] = ls
+	} else {
+		idx.removeTextLocked(ls)
+		delete(idx.owners[ls.model.UserID], ls.model.ID)
+		if tagIDs != nil {
+			idx.removeTagsLocked(ls)
+		}
+	}
+	ls.model = livestreamModel
+	ls.text = strings.ToLower(livestreamModel.Title + "\n" + livestreamModel.Description)
+	for _, bigram := range textBigrams(ls.text) {
+		addPosting(idx.bigrams, bigram, livestreamModel.ID)
+	}
+	addPosting(idx.owners, livestreamModel.UserID, livestreamModel.ID)
+	for _, tagID := range tagIDs {
+		idx.addTagLocked(livestreamModel.ID, tagID)
+	}
+}
+
+// setState はコミット済みの配信の状態を反映する
+func (idx *livestreamSearchIndex) setState(livestreamID int64, state string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if ls, ok := idx.livestreams[livestreamID]; ok {
+		ls.state = state
+	}
+}
+
+func (idx *livestreamSearchIndex) removeTagsLocked(ls *indexedLivestream) {
+	for tagID := range ls.tagIDs {
+		delete(idx.tags[tagID], ls.model.ID)
+	}
+	clear(ls.tagIDs)
+}
+
+func (idx *livestreamSearchIndex) removeTextLocked(ls *indexedLivestream) {
+	for _, bigram := range textBigrams(ls.text) {
+		if ids, ok := idx.bigrams[bigram]; ok {
+			delete(ids, ls.model.ID)
+			if len(ids) == 0 {
+				delete(idx.bigrams, bigram)
+			}
+		}
+	}
+}
+
+func (idx *livestreamSearchIndex) addTagLocked(livestreamID, tagID int64) {
+	ls, ok := idx.livestreams[livestreamID]
+	if !ok {
+		return
+	}
+	ls.tagIDs[tagID] = struct{}{}
+	addPosting(idx.tags, tagID, livestreamID)
+}
+
+// addReaction はコミット済みのリアクションを数える。読み込み時に数えたものは数えない
+func (idx *livestreamSearchIndex) addReaction(reactionModel ReactionModel) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if !idx.loaded || reactionModel.CreatedAt < idx.reactionsWindowStart {
+		return
+	}
+	if _, ok := idx.countedReactions[reactionModel.ID]; ok {
+		delete(idx.countedReactions, reactionModel.ID)
+		return
+	}
+	if ls, ok := idx.livestreams[reactionModel.LivestreamID]; ok {
+		ls.reactions++
+	}
+}
+
+func addPosting[K comparable](postings map[K]map[int64]struct{}, key K, livestreamID int64) {
+	ids, ok := postings[key]
+	if !ok {
+		ids = make(map[int64]struct{})
+		postings[key] = ids
+	}
+	ids[livestreamID] = struct{}{}
+}
+
+// textBigrams は空白を挟まない連続した2文字を重複なく返す
+func textBigrams(text string) []string {
+	seen := make(map[string]struct{})
+	var bigrams []string
+	runes := []rune(text)
+	for i := 0; i+1 < len(runes); i++ {
+		if unicode.IsSpace(runes[i]) || unicode.IsSpace(runes[i+1]) {
+			continue
+		}
+		bigram := string(runes[i : i+2])
+		if _, ok := seen[bigram]; !ok {
+			seen[bigram] = struct{}{}
+			bigrams = append(bigrams, bigram)
+		}
+	}
+	return bigrams
+}
+
+// searchResult は並び替えに使う値を持った検索結果
+type searchResult struct {
+	model LivestreamModel
+	key   pageKey
+	// sort=most_reactionsのときのリアクション数
+	reactions int64
+}
+
+// search は条件に合う配信を返す。tagIDsとownerIDはnilなら条件なし
+func (idx *livestreamSearchIndex) search(s livestreamSearch, tagIDs []int64, ownerID *int64, now int64) []searchResult {
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// 候補は最も絞れる転置リストから始め、残りの条件は配信ごとに確かめる
+	var candidates map[int64]struct{}
+	narrowed := false
+	narrow := func(ids map[int64]struct{}) {
+		if !narrowed || len(ids) < len(candidates) {
+			candidates = ids
+			narrowed = true
+		}
+	}
+	if ownerID != nil {
+		narrow(idx.owners[*ownerID])
+	}
+	if tagIDs != nil {
+		if s.allTags {
+			for _, tagID := range tagIDs {
+				narrow(idx.tags[tagID])
+			}
+		} else {
+			union := make(map[int64]struct{})
+			for _, tagID := range tagIDs {
+				maps.Copy(union, idx.tags[tagID])
+			}
+			narrow(union)
+		}
+	}
+	for _, keyword := range s.keywords {
+		for _, bigram := range textBigrams(keyword) {
+			narrow(idx.bigrams[bigram])
+		}
+	}
+	if !narrowed {
+		candidates = make(map[int64]struct{}, len(idx.livestreams))
+		for id := range idx.livestreams {
+			candidates[id] = struct{}{}
+		}
+	}
+
+	var results []searchResult
+	for id := range candidates {
+		ls := idx.livestreams[id]
+		if !ls.matches(s, tagIDs, ownerID, now) {
+			continue
+		}
+		r := searchResult{model: ls.model, reactions: ls.reactions}
+		switch s.sort {
+		case livestreamSortStartingSoon:
+			r.key = pageKey{CreatedAt: ls.model.StartAt, ID: ls.model.ID}
+		default:
+			r.key = pageKey{ID: ls.model.ID}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func (ls *indexedLivestream) matches(s livestreamSearch, tagIDs []int64, ownerID *int64, now int64) bool {
+	if ownerID != nil && ls.model.UserID != *ownerID {
+		return false
+	}
+	if tagIDs != nil {
+		hasTag := func(tagID int64) bool {
+			_, ok := ls.tagIDs[tagID]
+			return ok
+		}
+		if s.allTags && !allOf(tagIDs, hasTag) || !s.allTags && !slices.ContainsFunc(tagIDs, hasTag) {
+			return false
+		}
+	}
+	for _, keyword := range s.keywords {
+		if !strings.Contains(ls.text, keyword) {
+			return false
+		}
+	}
+	if s.startAtFrom != 0 && ls.model.StartAt < s.startAtFrom || s.startAtTo != 0 && ls.model.StartAt > s.startAtTo {
+		return false
+	}
+	if s.endAtFrom != 0 && ls.model.EndAt < s.endAtFrom || s.endAtTo != 0 && ls.model.EndAt > s.endAtTo {
+		return false
+	}
+	// 始まった配信は「もうすぐ始まる」に出さない
+	if s.sort == livestreamSortStartingSoon && ls.model.StartAt < now {
+		return false
+	}
+	return s.statuses.match(livestreamStatus(ls.model, ls.state, now))
+}
+
+func allOf[T any](items []T, f func(T) bool) bool {
+	for _, item := range items {
+		if !f(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchLivestreamModels は索引を引き、要求されたページの配信を返す
+func searchLivestreamModels(c echo.Context, s livestreamSearch, page pageRequest) ([]LivestreamModel, error) {
+	ctx := c.Request().Context()
+	if err := livestreamIndex.ensureLoaded(ctx); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to load livestream index: "+err.Error())
+	}
+
+	var tagIDs []int64
+	if len(s.tagNames) > 0 {
+		tagIDs = []int64{}
+		for _, name := range s.tagNames {
+			var ids []int64
+			if err := dbConn.SelectContext(ctx, &ids, "SELECT id FROM tags WHERE name = ?", name); err != nil {
+				return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+			}
+			if len(ids) == 0 && s.allTags {
+				// 存在しないタグが付いた配信はない
+				return []LivestreamModel{}, nil
+			}
+			tagIDs = append(tagIDs, ids...)
+		}
+	}
+
+	var ownerID *int64
+	if s.owner != "" {
+		var owner UserModel
+		if err := dbConn.GetContext(ctx, &owner, "SELECT * FROM users WHERE name = ?", s.owner); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return []LivestreamModel{}, nil
+			}
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get owner: "+err.Error())
+		}
+		ownerID = &owner.ID
+	}
+
+	results := livestreamIndex.search(s, tagIDs, ownerID, time.Now().Unix())
+	if s.sort == livestreamSortMostReactions {
+		// リアクション数はページを引く間にも変わるので、カーソルではなくoffsetで引く
+		slices.SortFunc(results, func(a, b searchResult) int {
+			return cmp.Or(cmp.Compare(b.reactions, a.reactions), cmp.Compare(b.model.ID, a.model.ID))
+		})
+		var err error
+		if results, err = paginateByOffset(c, page, results); err != nil {
+			return nil, err
+		}
+	} else {
+		results = paginate(c, page, results, func(r searchResult) pageKey {
+			return r.key
+		}, s.sort != livestreamSortStartingSoon)
+	}
+
+	livestreamModels := make([]LivestreamModel, len(results))
+	for i, r := range results {
+		livestreamModels[i] = r.model
+	}
+	return livestreamModels, nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	livestreamStatusScheduled = "scheduled"
+	livestreamStatusLive      = "live"
+	livestreamStatusEnded     = "ended"
+	livestreamStatusCancelled = "cancelled"
+)
+
+// LivestreamStateModel は配信者の操作で決まった状態。行がなければ期間だけで状態が決まる
+type LivestreamStateModel struct {
+	ID           int64  `db:"id"`
+	LivestreamID int64  `db:"livestream_id"`
+	Status       string `db:"status"`
+	UpdatedAt    int64  `db:"updated_at"`
+}
+
+// livestreamStatus は配信の状態を返す。stateは配信者の操作で決まった状態で、なければ空文字列
+func livestreamStatus(livestreamModel LivestreamModel, state string, now int64) string {
+	switch state {
+	case livestreamStatusCancelled, livestreamStatusEnded:
+		return state
+	}
+	if now >= livestreamModel.EndAt {
+		return livestreamStatusEnded
+	}
+	// 開始時刻より前に配信を始めることもできる
+	if state == livestreamStatusLive || now >= livestreamModel.StartAt {
+		return livestreamStatusLive
+	}
+	return livestreamStatusScheduled
+}
+
+func getLivestreamState(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (string, error) {
+	var stateModel LivestreamStateModel
+	if err := tx.GetContext(ctx, &stateModel, "SELECT * FROM livestream_states WHERE livestream_id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return "", nil
+		}
+		return "", err
+	}
+	return stateModel.Status, nil
+}
+
+// getLivestreamStates は一覧の配信の状態をまとめて引く。状態の行がない配信は含まない。
+// トランザクションの中では1回のクエリで、外からはlivestream_id = ?のキャッシュから引く
+func getLivestreamStates(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64) (map[int64]string, error) {
+	states := make(map[int64]string, len(livestreamIDs))
+	if len(livestreamIDs) == 0 {
+		return states, nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM livestream_states WHERE livestream_id IN (?)", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	var stateModels []LivestreamStateModel
+	if err := tx.SelectContext(ctx, &stateModels, query, args...); err != nil {
+		return nil, err
+	}
+	for _, stateModel := range stateModels {
+		states[stateModel.LivestreamID] = stateModel.Status
+	}
+	return states, nil
+}
+
+// getCancelledLivestreams はキャンセルされた配信を引く。統計から除くときに配信ごとに調べず一度だけ引く
+func getCancelledLivestreams(ctx context.Context, tx *sqlx.Tx) ([]LivestreamModel, error) {
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT l.* FROM livestreams l INNER JOIN livestream_states s ON s.livestream_id = l.id WHERE s.status = ?", livestreamStatusCancelled); err != nil {
+		return nil, err
+	}
+	return livestreamModels, nil
+}
+
+func getLivestreamStatus(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (string, error) {
+	state, err := getLivestreamState(ctx, tx, livestreamModel.ID)
+	if err != nil {
+		return "", err
+	}
+	return livestreamStatus(livestreamModel, state, time.Now().Unix()), nil
+}
+
+// rejectCancelledLivestream はキャンセルされた配信へのコメントやリアクション、入室を断る。
+// 書き込みのトランザクションの前にキャッシュから引く。状態の行がない配信の結果もキャッシュされるよう、状態も条件にする
+func rejectCancelledLivestream(ctx context.Context, livestreamID int64) error {
+	var stateModels []LivestreamStateModel
+	if err := dbConn.SelectContext(ctx, &stateModels, "SELECT * FROM livestream_states WHERE livestream_id = ? AND status = ?", livestreamID, livestreamStatusCancelled); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream status: "+err.Error())
+	}
+	if len(stateModels) > 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream is cancelled")
+	}
+	return nil
+}
+
+func setLivestreamState(ctx context.Context, tx *sqlx.Tx, livestreamID int64, status string) error {
+	state, err := getLivestreamState(ctx, tx, livestreamID)
+	if err != nil {
+		return err
+	}
+	stateModel := LivestreamStateModel{
+		LivestreamID: livestreamID,
+		Status:       status,
+		UpdatedAt:    time.Now().Unix(),
+	}
+	if state == "" {
+		_, err = tx.NamedExecContext(ctx, "INSERT INTO livestream_states (livestream_id, status, updated_at) VALUES (:livestream_id, :status, :updated_at)", stateModel)
+	} else {
+		_, err = tx.ExecContext(ctx, "UPDATE livestream_states SET status = ?, updated_at = ? WHERE livestream_id = ?", stateModel.Status, stateModel.UpdatedAt, stateModel.LivestreamID)
+	}
+	return err
+}
+
+// statusFilter は一覧と検索の status クエリ。nilなら指定なしで、キャンセルされた配信以外を返す
+type statusFilter map[string]struct{}
+
+// parseStatusFilter は status=live&status=ended と status=live,ended のどちらでも受け付ける
+func parseStatusFilter(c echo.Context) (statusFilter, error) {
+	var f statusFilter
+	for _, v := range c.QueryParams()["status"] {
+		for _, status := range strings.Split(v, ",") {
+			switch status {
+			case "":
+				continue
+			case livestreamStatusScheduled, livestreamStatusLive, livestreamStatusEnded, livestreamStatusCancelled:
+			default:
+				return nil, echo.NewHTTPError(http.StatusBadRequest, "status query parameter must be scheduled, live, ended or cancelled")
+			}
+			if f == nil {
+				f = make(statusFilter)
+			}
+			f[status] = struct{}{}
+		}
+	}
+	return f, nil
+}
+
+func (f statusFilter) match(status string) bool {
+	if f == nil {
+		return status != livestreamStatusCancelled
+	}
+	_, ok := f[status]
+	return ok
+}
+
+// livestreamStatusSQL はlivestreamStatusと同じ状態を求める式。lはlivestreams、sはLEFT JOINしたlivestream_statesで、引数には現在時刻を2つ渡す
+const livestreamStatusSQL = "CASE WHEN s.status IN ('" + livestreamStatusCancelled + "', '" + livestreamStatusEnded + "') THEN s.status" +
+	" WHEN ? >= l.end_at THEN '" + livestreamStatusEnded + "'" +
+	" WHEN s.status = '" + livestreamStatusLive + "' OR ? >= l.start_at THEN '" + livestreamStatusLive + "'" +
+	" ELSE '" + livestreamStatusScheduled + "' END"
+
+// sql はmatchと同じ条件をWHERE句に足す式で返す。lとsはlivestreamStatusSQLと同じ
+func (f statusFilter) sql(now int64) (string, []any) {
+	args := []any{now, now}
+	if f == nil {
+		return "(" + livestreamStatusSQL + ") <> '" + livestreamStatusCancelled + "'", args
+	}
+	placeholders := make([]string, 0, len(f))
+	for status := range f {
+		placeholders = append(placeholders, "?")
+		args = append(args, status)
+	}
+	return "(" + livestreamStatusSQL + ") IN (" + strings.Join(placeholders, ", ") + ")", args
+}
+
+// goLiveHandler は配信を始める。開始時刻より前でも始められる
+func goLiveHandler(c echo.Context) error {
+	return transitLivestreamHandler(c, livestreamStatusLive, func(status string) error {
+		if status != livestreamStatusScheduled && status != livestreamStatusLive {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't go live on a livestream that is "+status)
+		}
+		return nil
+	})
+}
+
+// endLivestreamHandler は配信中の配信を終了時刻より前に終える
+func endLivestreamHandler(c echo.Context) error {
+	return transitLivestreamHandler(c, livestreamStatusEnded, func(status string) error {
+		if status != livestreamStatusLive {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't end a livestream that is "+status)
+		}
+		return nil
+	})
+}
+
+// transitLivestreamHandler は自分の配信の状態をcheckで確かめてからtoにする
+func transitLivestreamHandler(c echo.Context, to string, check func(status string) error) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+	status, err := getLivestreamStatus(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream status: "+err.Error())
+	}
+	if err := check(status); err != nil {
+		return err
+	}
+	if err := setLivestreamState(ctx, tx, livestreamModel.ID, to); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream status: "+err.Error())
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	livestreamIndex.setState(livestreamModel.ID, to)
+
+	return c.JSON(http.StatusOK, livestream)
+}
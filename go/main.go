@@ -4,13 +4,19 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"os/signal"
 	"strconv"
+	"syscall"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/isucon/isucon13/webapp/go/cache"
@@ -26,12 +32,20 @@ import (
 const (
 	listenPort                     = 8080
 	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
+	cachePlanPath                  = "isuc.yaml"
+	cacheAccessLogPath             = "isuc-access.gob"
+	cacheSnapshotPathEnvKey        = "ISUCON13_CACHE_SNAPSHOT_PATH"
+	adminTokenEnvKey               = "ISUCON13_ADMIN_TOKEN"
+	// ウォームアップでクエリごとに読み込むキーの数
+	cacheWarmupKeys = 1000
 )
 
 var (
 	powerDNSSubdomainAddress string
 	dbConn                   *sqlx.DB
 	secret                   = []byte("isucon13_session_cookiestore_defaultsecret")
+	// 管理APIのBearerトークン。空なら管理APIは使えない
+	adminToken []byte
 )
 
 func init() {
@@ -39,6 +53,7 @@ func init() {
 	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
 		secret = []byte(secretKey)
 	}
+	adminToken = []byte(os.Getenv(adminTokenEnvKey))
 }
 
 type InitializeResponse struct {
@@ -54,6 +69,8 @@ func connectDB(echo.Logger) (*sqlx.DB, error) {
 		passwordEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
 		dbNameEnvKey      = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
 		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
+		replicaAddrEnvKey = "ISUCON13_MYSQL_REPLICA_ADDRESS"
+		replicaPortEnvKey = "ISUCON13_MYSQL_REPLICA_PORT"
 	)
 
 	conf := mysql.NewConfig()
@@ -95,6 +112,20 @@ func connectDB(echo.Logger) (*sqlx.DB, error) {
 		conf.ParseTime = parseTime
 	}
 
+	// レプリカが指定されていればキャッシュミスと読み込みをレプリカに流す
+	// 書き込み直後はレプリカの遅延で古い値を返さないよう、しばらくプライマリから読む
+	if addr, ok := os.LookupEnv(replicaAddrEnvKey); ok {
+		replicaConf := conf.Clone()
+		if port, ok2 := os.LookupEnv(replicaPortEnvKey); ok2 {
+			replicaConf.Addr = net.JoinHostPort(addr, port)
+		} else {
+			replicaConf.Addr = net.JoinHostPort(addr, "3306")
+		}
+		if err := cache.SetReadReplica(replicaConf.FormatDSN(), time.Second); err != nil {
+			return nil, err
+		}
+	}
+
 	db, err := sqlx.Open("mysql+cache", conf.FormatDSN())
 	if err != nil {
 		return nil, err
@@ -109,10 +140,22 @@ func connectDB(echo.Logger) (*sqlx.DB, error) {
 }
 
 func initializeHandler(c echo.Context) error {
+	// 書き込み待ちの行が初期化後のDBに入らないよう先に書き出す
+	if err := cache.FlushWriteBehind(c.Request().Context()); err != nil {
+		c.Logger().Warnf("failed to flush write-behind queues: %v", err)
+	}
 	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
 		c.Logger().Warnf("init.sh failed with err=%s", string(out))
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
+	// DBを作り直したのでキャッシュ・レプリカ・統計を捨てて、よく読まれるキーを読み込み直す
+	cache.Initialize()
+	livecommentEvents.reset()
+	reactionEvents.reset()
+	resetReactionCounters()
+	livestreamIndex.reset()
+	viewerPresence.reset()
+	go warmupCache()
 
 	c.Request().Header.Add("Content-Type", "application/json;charset=utf-8")
 	return c.JSON(http.StatusOK, InitializeResponse{
@@ -120,6 +163,12 @@ func initializeHandler(c echo.Context) error {
 	})
 }
 
+func warmupCache() {
+	if err := cache.Warmup(context.Background(), cacheWarmupKeys); err != nil {
+		log.Printf("failed to warm up cache: %v", err)
+	}
+}
+
 func main() {
 	e := echo.New()
 	e.Debug = true
@@ -128,6 +177,21 @@ func main() {
 	cookieStore := sessions.NewCookieStore(secret)
 	cookieStore.Options.Domain = "*.u.isucon.local"
 	e.Use(session.Middleware(cookieStore))
+	// キャッシュのヒット率やDB時間をエンドポイントごとに集計する
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			ctx := cache.WithTag(req.Context(), req.Method+" "+c.Path())
+			// 書き込んだユーザのその後の読み込みだけをプライマリに送る
+			if sess, err := session.Get(defaultSessionIDKey, c); err == nil {
+				if userID, ok := sess.Values[defaultUserIDKey].(int64); ok {
+					ctx = cache.WithSession(ctx, strconv.FormatInt(userID, 10))
+				}
+			}
+			c.SetRequest(req.WithContext(ctx))
+			return next(c)
+		}
+	})
 	// e.Use(middleware.Recover())
 
 	go func() {
@@ -135,9 +199,40 @@ func main() {
 		mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
 			w.Write([]byte(cache.ExportMetrics()))
 		})
+		mux.HandleFunc("/digest", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(cache.ExportQueryDigest())
+		})
+		mux.HandleFunc("/digest/tags", func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(cache.ExportTagStats())
+		})
+		mux.HandleFunc("POST /cache/reload", func(w http.ResponseWriter, r *http.Request) {
+			if err := cache.ReloadPlanFile(cachePlanPath); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		})
 		http.ListenAndServe(":10000", mux)
 	}()
 
+	// SIGHUPでキャッシュプランを再読み込み
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGHUP)
+		for range sigCh {
+			if err := cache.ReloadPlanFile(cachePlanPath); err != nil {
+				e.Logger.Errorf("failed to reload cache plan: %v", err)
+			}
+		}
+	}()
+
+	// キャッシュのメモリ上限 (全体 / クエリごと)
+	// アイコン画像は大きいので、他のクエリのキャッシュを追い出さないよう別枠にする
+	cache.SetMemoryLimit(1<<30, 256<<20)
+	cache.SetQueryMemoryLimit("SELECT image FROM icons WHERE user_id = ?", 128<<20)
+
 	dynamic_extractor.StartServer()
 
 	// 初期化
@@ -150,18 +245,48 @@ func main() {
 	// livestream
 	// reserve livestream
 	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	// 繰り返し予約
+	e.POST("/api/livestream/reservation/series", reserveLivestreamSeriesHandler)
+	e.GET("/api/livestream/reservation/series/:series_id", getLivestreamSeriesHandler)
+	e.DELETE("/api/livestream/reservation/series/:series_id", cancelLivestreamSeriesHandler)
+	// 予約枠のキャンセル待ち
+	e.POST("/api/livestream/waitlist", joinWaitlistHandler)
+	e.GET("/api/livestream/waitlist", getWaitlistHandler)
+	e.DELETE("/api/livestream/waitlist/:entry_id", leaveWaitlistHandler)
+	// 予約枠の残数
+	e.GET("/api/reservation_slots", getReservationSlotsHandler)
+	// 予約シーズンと予約枠の管理
+	e.GET("/api/admin/reservation_seasons", getReservationSeasonsHandler)
+	e.POST("/api/admin/reservation_seasons", postReservationSeasonHandler)
+	e.PUT("/api/admin/reservation_slots/capacity", putReservationSlotCapacityHandler)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	// 予約した配信の変更・キャンセル
+	e.PATCH("/api/livestream/:livestream_id", updateLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id", cancelLivestreamHandler)
+	// 配信の開始と終了
+	e.POST("/api/livestream/:livestream_id/live", goLiveHandler)
+	e.POST("/api/livestream/:livestream_id/end", endLivestreamHandler)
+	// コラボレーター
+	e.GET("/api/livestream/invitations", getCohostInvitationsHandler)
+	e.GET("/api/livestream/:livestream_id/collaborators", getLivestreamCohostsHandler)
+	e.POST("/api/livestream/:livestream_id/collaborators", inviteLivestreamCohostHandler)
+	e.POST("/api/livestream/:livestream_id/collaborators/accept", acceptLivestreamCohostHandler)
+	e.DELETE("/api/livestream/:livestream_id/collaborators/:user_id", removeLivestreamCohostHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
 	// ライブコメント投稿
 	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
+	// ライブコメントのSSEストリーム
+	e.GET("/api/livestream/:livestream_id/livecomment/stream", streamLivecommentsHandler)
 	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	// リアクションと絵文字ごとの集計のWebSocket
+	e.GET("/api/livestream/:livestream_id/reaction/ws", streamReactionsHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
@@ -176,11 +301,18 @@ func main() {
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	// 視聴継続の通知 (viewer)
+	e.POST("/api/livestream/:livestream_id/heartbeat", heartbeatLivestreamHandler)
+	// 現在の視聴者数と同時視聴者数の最大値
+	e.GET("/api/livestream/:livestream_id/viewers", getLivestreamViewersHandler)
 
 	// user
 	e.POST("/api/register", registerHandler)
 	e.POST("/api/login", loginHandler)
 	e.GET("/api/user/me", getMeHandler)
+	// 視聴した配信と、最近視聴した配信者
+	e.GET("/api/user/me/history", getMyWatchHistoryHandler)
+	e.GET("/api/user/me/history/streamers", getMyRecentStreamersHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
 	e.GET("/api/user/:username", getUserHandler)
 	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
@@ -205,6 +337,22 @@ func main() {
 	defer conn.Close()
 	dbConn = conn
 
+	// 前回のアクセス履歴とスナップショットからキャッシュを温める
+	if err := cache.LoadAccessLog(cacheAccessLogPath); err != nil {
+		e.Logger.Warnf("failed to load cache access log: %v", err)
+	}
+	snapshotPath := os.Getenv(cacheSnapshotPathEnvKey)
+	if snapshotPath != "" {
+		if err := cache.LoadSnapshot(snapshotPath); err != nil {
+			e.Logger.Warnf("failed to load cache snapshot: %v", err)
+		}
+	}
+	go warmupCache()
+	// ハートビートの途切れた視聴を終える
+	go expireViewerSessions()
+	// 繰り上げ損ねたキャンセル待ちを拾い、締め切りを過ぎたものを期限切れにする
+	go sweepWaitlist(e)
+
 	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
 	if !ok {
 		e.Logger.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
@@ -214,19 +362,61 @@ func main() {
 
 	// HTTPサーバ起動
 	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
-	if err := e.Start(listenAddr); err != nil {
+	// SIGINT / SIGTERMで受付を止め、書き込み待ちの行をDBに書き出してから終了
+	// ストリームはリクエストが終わらないので、終了処理の開始時に切断する
+	e.Server.RegisterOnShutdown(livecommentEvents.close)
+	e.Server.RegisterOnShutdown(reactionEvents.close)
+	shutdownDone := make(chan struct{})
+	go func() {
+		defer close(shutdownDone)
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := e.Shutdown(ctx); err != nil {
+			e.Logger.Errorf("failed to shutdown HTTP server: %v", err)
+		}
+	}()
+	if err := e.Start(listenAddr); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		e.Logger.Errorf("failed to start HTTP server: %v", err)
 		os.Exit(1)
 	}
+	// 処理中のリクエストが終わるのを待つ
+	<-shutdownDone
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := flushViewerSessions(ctx); err != nil {
+		e.Logger.Errorf("failed to save watch times of viewers: %v", err)
+	}
+	if err := cache.FlushWriteBehind(ctx); err != nil {
+		e.Logger.Errorf("failed to flush write-behind queues: %v", err)
+	}
+	if err := cache.SaveAccessLog(cacheAccessLogPath); err != nil {
+		e.Logger.Errorf("failed to save cache access log: %v", err)
+	}
+	if snapshotPath != "" {
+		if err := cache.SaveSnapshot(snapshotPath); err != nil {
+			e.Logger.Errorf("failed to save cache snapshot: %v", err)
+		}
+	}
 }
 
 type ErrorResponse struct {
 	Error string `json:"error"`
+	// 予約のルールに反したときのエラーコード
+	Code string `json:"code,omitempty"`
 }
 
 func errorResponseHandler(err error, c echo.Context) {
 	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
 	if he, ok := err.(*echo.HTTPError); ok {
+		if v, ok := he.Message.(*ScheduleViolation); ok {
+			if e := c.JSON(he.Code, &ErrorResponse{Error: v.Message, Code: v.Code}); e != nil {
+				c.Logger().Errorf("%+v", e)
+			}
+			return
+		}
 		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
 			c.Logger().Errorf("%+v", e)
 		}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"cmp"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// pageKey は一覧の中での位置。created_atのない一覧ではIDだけを使う
+type pageKey struct {
+	CreatedAt int64
+	ID        int64
+}
+
+func (k pageKey) compare(o pageKey) int {
+	return cmp.Or(cmp.Compare(k.CreatedAt, o.CreatedAt), cmp.Compare(k.ID, o.ID))
+}
+
+// カーソルは中身に依存されないよう不透明な文字列にする
+func (k pageKey) cursor() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%d", k.CreatedAt, k.ID)))
+}
+
+func parseCursor(s string) (pageKey, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return pageKey{}, err
+	}
+	createdAt, id, ok := strings.Cut(string(b), ":")
+	if !ok {
+		return pageKey{}, fmt.Errorf("malformed cursor")
+	}
+	var k pageKey
+	if k.CreatedAt, err = strconv.ParseInt(createdAt, 10, 64); err != nil {
+		return pageKey{}, err
+	}
+	if k.ID, err = strconv.ParseInt(id, 10, 64); err != nil {
+		return pageKey{}, err
+	}
+	return k, nil
+}
+
+// pageRequest は limit と、一覧の並び順でカーソルより後 (after) または前 (before) のどちらか
+type pageRequest struct {
+	limit  int
+	after  *pageKey
+	before *pageKey
+}
+
+func (p pageRequest) active() bool {
+	return p.limit > 0 || p.after != nil || p.before != nil
+}
+
+func parsePageRequest(c echo.Context) (pageRequest, error) {
+	var p pageRequest
+	if v := c.QueryParam("limit"); v != "" {
+		// limitを付けなければ全件を返す。0は全件の意味にしない
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return p, echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be positive integer")
+		}
+		p.limit = limit
+	}
+	if c.QueryParam("after") != "" && c.QueryParam("before") != "" {
+		return p, echo.NewHTTPError(http.StatusBadRequest, "after and before query parameters cannot be used together")
+	}
+	for name, dst := range map[string]**pageKey{"after": &p.after, "before": &p.before} {
+		if v := c.QueryParam(name); v != "" {
+			k, err := parseCursor(v)
+			if err != nil {
+				return p, echo.NewHTTPError(http.StatusBadRequest, name+" query parameter must be a cursor returned in the Link header")
+			}
+			*dst = &k
+		}
+	}
+	return p, nil
+}
+
+// paginate はitemsをkeyの順 (descなら降順) に並べ、要求されたページを切り出してLinkヘッダを付ける
+func paginate[T any](c echo.Context, p pageRequest, items []T, key func(T) pageKey, desc bool) []T {
+	order := func(a, b T) int {
+		if desc {
+			return key(b).compare(key(a))
+		}
+		return key(a).compare(key(b))
+	}
+	slices.SortStableFunc(items, order)
+	if !p.active() {
+		return items
+	}
+
+	// 一覧の並び順でカーソルより後にあるか
+	isAfter := func(item T, cursor pageKey) bool {
+		if desc {
+			return key(item).compare(cursor) < 0
+		}
+		return key(item).compare(cursor) > 0
+	}
+	start, end := 0, len(items)
+	if p.after != nil {
+		start, _ = slices.BinarySearchFunc(items, *p.after, func(item T, cursor pageKey) int {
+			if isAfter(item, cursor) {
+				return 1
+			}
+			return -1
+		})
+	}
+	if p.before != nil {
+		end, _ = slices.BinarySearchFunc(items, *p.before, func(item T, cursor pageKey) int {
+			if isAfter(item, cursor) || key(item) == cursor {
+				return 1
+			}
+			return -1
+		})
+	}
+	if p.limit > 0 {
+		if p.before != nil {
+			start = max(start, end-p.limit)
+		} else {
+			end = min(end, start+p.limit)
+		}
+	}
+	page := items[start:end]
+
+	var prev, next *pageKey
+	if len(page) > 0 {
+		if start > 0 {
+			k := key(page[0])
+			prev = &k
+		}
+		if end < len(items) {
+			k := key(page[len(page)-1])
+			next = &k
+		}
+	}
+	setPageLinks(c, prev, next)
+	return page
+}
+
+// paginateByOffset は並びが変わる一覧 (リアクション数順など) のためにカーソルではなくoffsetで切り出し、Linkヘッダを付ける。
+// ページを引く間に並びが変わると、行が重複したり抜けたりする
+func paginateByOffset[T any](c echo.Context, p pageRequest, items []T) ([]T, error) {
+	if p.after != nil || p.before != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "this list is paged with offset, not with after or before")
+	}
+	offset := 0
+	if v := c.QueryParam("offset"); v != "" {
+		var err error
+		if offset, err = strconv.Atoi(v); err != nil || offset < 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "offset query parameter must be non-negative integer")
+		}
+	}
+	start := min(offset, len(items))
+	end := len(items)
+	if p.limit > 0 {
+		end = min(end, start+p.limit)
+	}
+
+	var links []string
+	link := func(offset int, rel string) {
+		u := *c.Request().URL
+		q := u.Query()
+		q.Set("offset", strconv.Itoa(offset))
+		u.RawQuery = q.Encode()
+		links = append(links, fmt.Sprintf("<%s>; rel=\"%s\"", u.RequestURI(), rel))
+	}
+	if end < len(items) {
+		link(end, "next")
+	}
+	if start > 0 && p.limit > 0 {
+		link(max(start-p.limit, 0), "prev")
+	}
+	if len(links) > 0 {
+		c.Response().Header().Set("Link", strings.Join(links, ", "))
+	}
+	return items[start:end], nil
+}
+
+// sql は要求されたページだけを引くためにWHERE句の後ろに足す条件とORDER BY、LIMITを返す。
+// 一覧は (createdAtColumn, idColumn) の順 (descなら降順) で、createdAtColumnが空ならidColumnだけで並べる。
+// 次のページがあるかを知るためlimitより1行多く引き、前のページ (before) は逆順に引くので、引いた行はcutPageに渡す
+func (p pageRequest) sql(createdAtColumn, idColumn string, desc bool) (string, []any) {
+	columns, placeholders := idColumn, "?"
+	cursorArgs := func(k pageKey) []any { return []any{k.ID} }
+	if createdAtColumn != "" {
+		columns, placeholders = "("+createdAtColumn+", "+idColumn+")", "(?, ?)"
+		cursorArgs = func(k pageKey) []any { return []any{k.CreatedAt, k.ID} }
+	}
+
+	var query string
+	var args []any
+	// 一覧の並び順でカーソルより後 (after) か前 (before) か
+	if p.after != nil {
+		op := ">"
+		if desc {
+			op = "<"
+		}
+		query += " AND " + columns + " " + op + " " + placeholders
+		args = append(args, cursorArgs(*p.after)...)
+	}
+	if p.before != nil {
+		op := "<"
+		if desc {
+			op = ">"
+		}
+		query += " AND " + columns + " " + op + " " + placeholders
+		args = append(args, cursorArgs(*p.before)...)
+	}
+
+	dir := "ASC"
+	if desc != (p.before != nil) {
+		dir = "DESC"
+	}
+	query += " ORDER BY "
+	if createdAtColumn != "" {
+		query += createdAtColumn + " " + dir + ", "
+	}
+	query += idColumn + " " + dir
+	if p.limit > 0 {
+		query += " LIMIT ?"
+		args = append(args, p.limit+1)
+	}
+	return query, args
+}
+
+// cutPage はpageRequest.sqlで引いた行を一覧の並び順のページにして、Linkヘッダを付ける
+func cutPage[T any](c echo.Context, p pageRequest, rows []T, key func(T) pageKey) []T {
+	more := p.limit > 0 && len(rows) > p.limit
+	if more {
+		rows = rows[:p.limit]
+	}
+	if p.before != nil {
+		slices.Reverse(rows)
+	}
+
+	var prev, next *pageKey
+	if len(rows) > 0 {
+		first, last := key(rows[0]), key(rows[len(rows)-1])
+		if p.before != nil {
+			// カーソルの行が後ろにある
+			next = &last
+			if more {
+				prev = &first
+			}
+		} else {
+			if p.after != nil {
+				prev = &first
+			}
+			if more {
+				next = &last
+			}
+		}
+	}
+	setPageLinks(c, prev, next)
+	return rows
+}
+
+// setPageLinks は前後のページのURLをLinkヘッダで返す
+func setPageLinks(c echo.Context, prev, next *pageKey) {
+	var links []string
+	link := func(param string, k pageKey, rel string) {
+		u := *c.Request().URL
+		q := u.Query()
+		q.Del("after")
+		q.Del("before")
+		q.Set(param, k.cursor())
+		u.RawQuery = q.Encode()
+		links = append(links, fmt.Sprintf("<%s>; rel=\"%s\"", u.RequestURI(), rel))
+	}
+	if next != nil {
+		link("after", *next, "next")
+	}
+	if prev != nil {
+		link("before", *prev, "prev")
+	}
+	if len(links) > 0 {
+		c.Response().Header().Set("Link", strings.Join(links, ", "))
+	}
+}
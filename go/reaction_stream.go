@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"maps"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const (
+	// 絵文字ごとのリアクション数を送る間隔
+	reactionCountsInterval = time.Second
+	// 書き込みがこれ以上詰まったクライアントは切断する
+	reactionStreamWriteTimeout = 5 * time.Second
+	// 読み込み時にまだコミットされていない可能性があるとみなすリアクションの古さ(秒)。
+	// これより新しいリアクションはIDで数えたかどうかを覚えておく
+	reactionCountWindow = 60
+)
+
+var reactionEvents = newEventHub()
+
+// ReactionEvent はWebSocketで送るリアクション。UserやLivestreamは埋め込まない
+type ReactionEvent struct {
+	ID        int64  `json:"id"`
+	EmojiName string `json:"emoji_name"`
+	UserID    int64  `json:"user_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+type ReactionStreamMessage struct {
+	Type string `json:"type"`
+	// type=reactionのとき
+	Reaction json.RawMessage `json:"reaction,omitempty"`
+	// type=countsのとき
+	Counts map[string]int64 `json:"counts,omitempty"`
+}
+
+// reactionCounter は配信ごとの絵文字別リアクション数。初回参照時にDBから数える
+type reactionCounter struct {
+	mu     sync.Mutex
+	loaded bool
+	counts map[string]int64
+	// 読み込み時の時刻からreactionCountWindowだけ遡った時刻。これより前のリアクションは読み込み時に数えている
+	windowStart int64
+	// 読み込み時に数えたリアクションのうち、windowStart以降に作られたもののID。
+	// IDは採番順にコミットされるとは限らないので、最大IDではなく数えたIDそのものを覚えておく
+	counted map[int64]struct{}
+}
+
+var reactionCounters = struct {
+	mu          sync.Mutex
+	livestreams map[int64]*reactionCounter
+}{
+	livestreams: make(map[int64]*reactionCounter),
+}
+
+func reactionCounterFor(livestreamID int64) *reactionCounter {
+	reactionCounters.mu.Lock()
+	defer reactionCounters.mu.Unlock()
+	rc, ok := reactionCounters.livestreams[livestreamID]
+	if !ok {
+		rc = &reactionCounter{counts: make(map[string]int64)}
+		reactionCounters.livestreams[livestreamID] = rc
+	}
+	return rc
+}
+
+func resetReactionCounters() {
+	reactionCounters.mu.Lock()
+	defer reactionCounters.mu.Unlock()
+	clear(reactionCounters.livestreams)
+}
+
+func (rc *reactionCounter) snapshot(ctx context.Context, livestreamID int64) (map[string]int64, error) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if !rc.loaded {
+		// 読み込み後に届いたリアクションだけを足すため、最近のリアクションは1件ずつ取って数えたIDを覚える。
+		// それより古いリアクションはコミット済みとみなして絵文字ごとに集計する
+		windowStart := time.Now().Unix() - reactionCountWindow
+		var emojiCounts []struct {
+			EmojiName string `db:"emoji_name"`
+			Count     int64  `db:"count"`
+		}
+		if err := dbConn.SelectContext(ctx, &emojiCounts, "SELECT emoji_name, COUNT(*) AS count FROM reactions WHERE livestream_id = ? AND created_at < ? GROUP BY emoji_name", livestreamID, windowStart); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		var recent []struct {
+			ID        int64  `db:"id"`
+			EmojiName string `db:"emoji_name"`
+		}
+		if err := dbConn.SelectContext(ctx, &recent, "SELECT id, emoji_name FROM reactions WHERE livestream_id = ? AND created_at >= ?", livestreamID, windowStart); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return nil, err
+		}
+		for _, ec := range emojiCounts {
+			rc.counts[ec.EmojiName] = ec.Count
+		}
+		rc.windowStart = windowStart
+		rc.counted = make(map[int64]struct{}, len(recent))
+		for _, r := range recent {
+			rc.counts[r.EmojiName]++
+			rc.counted[r.ID] = struct{}{}
+		}
+		rc.loaded = true
+	}
+	return maps.Clone(rc.counts), nil
+}
+
+// add は読み込み前と、読み込み時に数えたリアクションなら何もしない
+func (rc *reactionCounter) add(reactionModel ReactionModel) {
+	rc.mu.Lock()
+	defer rc.mu.Unlock()
+	if !rc.loaded || reactionModel.CreatedAt < rc.windowStart {
+		return
+	}
+	if _, ok := rc.counted[reactionModel.ID]; ok {
+		// 配られるのは1度だけなので、以降は覚えておかなくてよい
+		delete(rc.counted, reactionModel.ID)
+		return
+	}
+	rc.counts[reactionModel.EmojiName]++
+}
+
+// publishReaction はコミット済みのリアクションを数えて、購読者に配る
+func publishReaction(reactionModel ReactionModel) error {
+	reactionCounterFor(reactionModel.LivestreamID).add(reactionModel)
+	livestreamIndex.addReaction(reactionModel)
+	return reactionEvents.publish(reactionModel.LivestreamID, "reaction", ReactionEvent{
+		ID:        reactionModel.ID,
+		EmojiName: reactionModel.EmojiName,
+		UserID:    reactionModel.UserID,
+		CreatedAt: reactionModel.CreatedAt,
+	})
+}
+
+func streamReactionsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var livestreamModel LivestreamModel
+	if err := dbConn.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if _, err := reactionCounterFor(livestreamModel.ID).snapshot(ctx, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+
+	// Originを検査するとブラウザ以外から繋げないので、Handshakeは指定しない
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+		if err := serveReactionStream(ctx, ws, livestreamModel.ID); err != nil {
+			c.Logger().Debugf("reaction stream closed: %v", err)
+		}
+	}}.ServeHTTP(c.Response(), c.Request())
+	return nil
+}
+
+func serveReactionStream(ctx context.Context, ws *websocket.Conn, livestreamID int64) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	// クライアントからのメッセージは使わないが、切断を検知するために読み続ける
+	go func() {
+		defer cancel()
+		var msg string
+		for websocket.Message.Receive(ws, &msg) == nil {
+		}
+	}()
+
+	send := func(msg ReactionStreamMessage) error {
+		ws.SetWriteDeadline(time.Now().Add(reactionStreamWriteTimeout))
+		return websocket.JSON.Send(ws, msg)
+	}
+
+	// 変わっていなければ送らない
+	var lastCounts map[string]int64
+	sendCounts := func() error {
+		// 初期化で数え直されることがあるので毎回引く
+		counts, err := reactionCounterFor(livestreamID).snapshot(ctx, livestreamID)
+		if err != nil {
+			return err
+		}
+		if lastCounts != nil && maps.Equal(counts, lastCounts) {
+			return nil
+		}
+		lastCounts = counts
+		return send(ReactionStreamMessage{Type: "counts", Counts: counts})
+	}
+
+	ticker := time.NewTicker(reactionCountsInterval)
+	defer ticker.Stop()
+	for {
+		if err := sendCounts(); err != nil {
+			return err
+		}
+		sub, _, _ := reactionEvents.subscribe(livestreamID, hubEventID{})
+		err := relayReactions(ctx, sub, send, sendCounts, ticker.C)
+		reactionEvents.unsubscribe(livestreamID, sub)
+		if err != nil || reactionEvents.isClosed() {
+			return err
+		}
+		// 追いつけずに購読を切られた。捨てたリアクションは集計にだけ反映して購読し直す
+		lastCounts = nil
+	}
+}
+
+// relayReactions は購読が切られるまでリアクションと定期的な集計を送る
+func relayReactions(ctx context.Context, sub *hubSubscriber, send func(ReactionStreamMessage) error, sendCounts func() error, tick <-chan time.Time) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-sub.ch:
+			if !ok {
+				return nil
+			}
+			if err := send(ReactionStreamMessage{Type: "reaction", Reaction: ev.Data}); err != nil {
+				return err
+			}
+		case <-tick:
+			if err := sendCounts(); err != nil {
+				return err
+			}
+		}
+	}
+}
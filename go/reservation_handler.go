@@ -0,0 +1,374 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ReservationSeasonModel は配信を予約できる期間
+type ReservationSeasonModel struct {
+	ID      int64  `db:"id" json:"id"`
+	Name    string `db:"name" json:"name"`
+	StartAt int64  `db:"start_at" json:"start_at"`
+	EndAt   int64  `db:"end_at" json:"end_at"`
+}
+
+// UpdateLivestreamRequest は指定されたフィールドだけを変更する
+type UpdateLivestreamRequest struct {
+	Tags         *[]int64 `json:"tags"`
+	Title        *string  `json:"title"`
+	Description  *string  `json:"description"`
+	PlaylistUrl  *string  `json:"playlist_url"`
+	ThumbnailUrl *string  `json:"thumbnail_url"`
+	StartAt      *int64   `json:"start_at"`
+	EndAt        *int64   `json:"end_at"`
+}
+
+// findReservationSeason は予約区間が重なるシーズンを返す。どのシーズンとも重ならなければ予約できない
+func findReservationSeason(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) (ReservationSeasonModel, error) {
+	var seasons []ReservationSeasonModel
+	if err := tx.SelectContext(ctx, &seasons, "SELECT * FROM reservation_seasons"); err != nil {
+		return ReservationSeasonModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_seasons: "+err.Error())
+	}
+	for _, season := range seasons {
+		if startAt < season.EndAt && endAt > season.StartAt {
+			return season, nil
+		}
+	}
+	return ReservationSeasonModel{}, newScheduleViolation(scheduleErrorOutOfSeason, "bad reservation time range")
+}
+
+// takeReservationSlots は予約区間の予約枠を調べ、空いていれば1つずつ確保する
+func takeReservationSlots(ctx context.Context, c echo.Context, tx *sqlx.Tx, season ReservationSeasonModel, startAt, endAt int64) error {
+	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
+	var slots []*ReservationSlotModel
+	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? FOR UPDATE", startAt, endAt); err != nil {
+		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	for _, slot := range slots {
+		var count int
+		if err := tx.GetContext(ctx, &count, "SELECT slot FROM reservation_slots WHERE start_at = ? AND end_at = ?", slot.StartAt, slot.EndAt); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+		}
+		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
+		if count < 1 {
+			return newScheduleViolation(scheduleErrorSlotFullyBooked, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", season.StartAt, season.EndAt, startAt, endAt))
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
+	}
+	return nil
+}
+
+// refundReservationSlots はtakeReservationSlotsで確保した予約枠を返す
+func refundReservationSlots(ctx context.Context, tx *sqlx.Tx, startAt, endAt int64) error {
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ?", startAt, endAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to refund reservation_slot: "+err.Error())
+	}
+	return nil
+}
+
+func insertLivestreamTags(ctx context.Context, tx *sqlx.Tx, livestreamID int64, tagIDs []int64) error {
+	for _, tagID := range tagIDs {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_tags (livestream_id, tag_id) VALUES (:livestream_id, :tag_id)", &LivestreamTagModel{
+			LivestreamID: livestreamID,
+			TagID:        tagID,
+		}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertReservation は予約のルールを調べ、予約枠を確保して配信とタグを登録する
+func insertReservation(ctx context.Context, c echo.Context, tx *sqlx.Tx, userID int64, req *ReserveLivestreamRequest) (*LivestreamModel, error) {
+	if err := checkReservationTimeRange(req.StartAt, req.EndAt); err != nil {
+		return nil, err
+	}
+	season, err := findReservationSeason(ctx, tx, req.StartAt, req.EndAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := takeReservationSlots(ctx, c, tx, season, req.StartAt, req.EndAt); err != nil {
+		return nil, err
+	}
+	if err := checkReservationOverlap(ctx, tx, userID, 0, req.StartAt, req.EndAt); err != nil {
+		return nil, err
+	}
+	if err := checkUpcomingReservations(ctx, tx, userID); err != nil {
+		return nil, err
+	}
+
+	var (
+		livestreamModel = &LivestreamModel{
+			UserID:       userID,
+			Title:        req.Title,
+			Description:  req.Description,
+			PlaylistUrl:  req.PlaylistUrl,
+			ThumbnailUrl: req.ThumbnailUrl,
+			StartAt:      req.StartAt,
+			EndAt:        req.EndAt,
+		}
+	)
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+	}
+
+	livestreamID, err := rs.LastInsertId()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+	}
+	livestreamModel.ID = livestreamID
+
+	// タグ追加
+	if err := insertLivestreamTags(ctx, tx, livestreamID, req.Tags); err != nil {
+		return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+	}
+	if _, err := inviteCohosts(ctx, tx, *livestreamModel, req.Collaborators); err != nil {
+		return nil, err
+	}
+	return livestreamModel, nil
+}
+
+// commitReservation はinsertReservationしたtxをコミットし、検索の索引に反映する
+func commitReservation(tx *sqlx.Tx, tagIDs []int64, livestreamModels ...LivestreamModel) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, livestreamModel := range livestreamModels {
+		livestreamIndex.add(livestreamModel, tagIDs)
+	}
+	return nil
+}
+
+// cancelReservation は始まっていない配信の予約枠を返してキャンセル済みにする。配信は一覧に残す
+func cancelReservation(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) error {
+	status, err := getLivestreamStatus(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream status: "+err.Error())
+	}
+	if status != livestreamStatusScheduled {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't cancel a livestream that is "+status)
+	}
+	if err := refundReservationSlots(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+		return err
+	}
+	if err := setLivestreamState(ctx, tx, livestreamModel.ID, livestreamStatusCancelled); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream status: "+err.Error())
+	}
+	return nil
+}
+
+// commitCancellation はcancelReservationしたtxをコミットし、検索の索引に反映してからキャンセル待ちを繰り上げる
+func commitCancellation(ctx context.Context, c echo.Context, tx *sqlx.Tx, livestreamModels ...LivestreamModel) error {
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	for _, livestreamModel := range livestreamModels {
+		livestreamIndex.setState(livestreamModel.ID, livestreamStatusCancelled)
+	}
+	for _, livestreamModel := range livestreamModels {
+		promoteWaitlist(ctx, c, livestreamModel.StartAt, livestreamModel.EndAt)
+	}
+	return nil
+}
+
+// lockLivestream は配信を行ロックを取って引く。配信の変更やキャンセル、コラボレーターの変更を直列にする
+func lockLivestream(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (LivestreamModel, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		}
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	return livestreamModel, nil
+}
+
+// getOwnedLivestreamForUpdate は自分の配信を行ロックを取って引く
+func getOwnedLivestreamForUpdate(ctx context.Context, tx *sqlx.Tx, livestreamID, userID int64) (LivestreamModel, error) {
+	livestreamModel, err := lockLivestream(ctx, tx, livestreamID)
+	if err != nil {
+		return LivestreamModel{}, err
+	}
+	if livestreamModel.UserID != userID {
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusForbidden, "can't modify other streamer's livestream")
+	}
+	return livestreamModel, nil
+}
+
+func updateLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	var req *UpdateLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	current, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+	status, err := getLivestreamStatus(ctx, tx, current)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream status: "+err.Error())
+	}
+	if status == livestreamStatusCancelled {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't update a cancelled livestream")
+	}
+
+	livestreamModel := current
+	if req.Title != nil {
+		livestreamModel.Title = *req.Title
+	}
+	if req.Description != nil {
+		livestreamModel.Description = *req.Description
+	}
+	if req.PlaylistUrl != nil {
+		livestreamModel.PlaylistUrl = *req.PlaylistUrl
+	}
+	if req.ThumbnailUrl != nil {
+		livestreamModel.ThumbnailUrl = *req.ThumbnailUrl
+	}
+	if req.StartAt != nil {
+		livestreamModel.StartAt = *req.StartAt
+	}
+	if req.EndAt != nil {
+		livestreamModel.EndAt = *req.EndAt
+	}
+
+	// 期間を変えるときは元の予約枠を返してから、新しい期間の予約枠を取り直す
+	if livestreamModel.StartAt != current.StartAt || livestreamModel.EndAt != current.EndAt {
+		if current.StartAt <= time.Now().Unix() {
+			return echo.NewHTTPError(http.StatusBadRequest, "can't change the time range of a livestream that has already started")
+		}
+		if err := checkReservationTimeRange(livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+			return err
+		}
+		season, err := findReservationSeason(ctx, tx, livestreamModel.StartAt, livestreamModel.EndAt)
+		if err != nil {
+			return err
+		}
+		if err := refundReservationSlots(ctx, tx, current.StartAt, current.EndAt); err != nil {
+			return err
+		}
+		if err := takeReservationSlots(ctx, c, tx, season, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+			return err
+		}
+		if err := checkReservationOverlap(ctx, tx, userID, livestreamModel.ID, livestreamModel.StartAt, livestreamModel.EndAt); err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET title = ?, description = ?, playlist_url = ?, thumbnail_url = ?, start_at = ?, end_at = ? WHERE id = ?",
+		livestreamModel.Title, livestreamModel.Description, livestreamModel.PlaylistUrl, livestreamModel.ThumbnailUrl, livestreamModel.StartAt, livestreamModel.EndAt, livestreamModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	// タグは指定されたときだけ入れ替える
+	var tagIDs []int64
+	if req.Tags != nil {
+		tagIDs = append([]int64{}, *req.Tags...)
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+		}
+		if err := insertLivestreamTags(ctx, tx, livestreamModel.ID, tagIDs); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tag: "+err.Error())
+		}
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	livestreamIndex.add(livestreamModel, tagIDs)
+	if livestreamModel.StartAt != current.StartAt || livestreamModel.EndAt != current.EndAt {
+		promoteWaitlist(ctx, c, current.StartAt, current.EndAt)
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+func cancelLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnedLivestreamForUpdate(ctx, tx, int64(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+	if livestreamModel.StartAt <= time.Now().Unix() {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't cancel a livestream that has already started")
+	}
+
+	if err := cancelReservation(ctx, tx, livestreamModel); err != nil {
+		return err
+	}
+
+	if err := commitCancellation(ctx, c, tx, livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 予約のルールに反したときのエラーコード
+const (
+	scheduleErrorInvalidRange    = "invalid_time_range"
+	scheduleErrorOverlapping     = "overlapping_reservation"
+	scheduleErrorTooShort        = "duration_too_short"
+	scheduleErrorTooLong         = "duration_too_long"
+	scheduleErrorLeadTime        = "lead_time_too_short"
+	scheduleErrorTooManyUpcoming = "too_many_upcoming_reservations"
+	scheduleErrorOutOfSeason     = "out_of_reservation_season"
+	scheduleErrorSlotFullyBooked = "reservation_slot_fully_booked"
+)
+
+// 予約のルールの値を上書きする環境変数。0にしたルールは調べない
+const (
+	reservationMinDurationEnvKey = "ISUCON13_RESERVATION_MIN_DURATION"
+	reservationMaxDurationEnvKey = "ISUCON13_RESERVATION_MAX_DURATION"
+	reservationMinLeadTimeEnvKey = "ISUCON13_RESERVATION_MIN_LEAD_TIME"
+	reservationMaxUpcomingEnvKey = "ISUCON13_RESERVATION_MAX_UPCOMING"
+)
+
+// reservationPolicy は予約のルール。0のルールは調べない
+type reservationPolicy struct {
+	// 配信の長さ (秒)
+	MinDuration int64
+	MaxDuration int64
+	// 予約してから配信が始まるまでに空けるべき時間 (秒)
+	MinLeadTime int64
+	// 1人の配信者がまだ始まっていない配信を予約できる数
+	MaxUpcoming int64
+}
+
+// schedulingPolicy は既定で全てのルールを調べる。値は環境変数で1つずつ変えられる
+var schedulingPolicy = reservationPolicy{
+	MinDuration: reservationSlotDuration,
+	MaxDuration: 24 * 60 * 60,
+	MinLeadTime: 10 * 60,
+	MaxUpcoming: 100,
+}
+
+func init() {
+	for envKey, dst := range map[string]*int64{
+		reservationMinDurationEnvKey: &schedulingPolicy.MinDuration,
+		reservationMaxDurationEnvKey: &schedulingPolicy.MaxDuration,
+		reservationMinLeadTimeEnvKey: &schedulingPolicy.MinLeadTime,
+		reservationMaxUpcomingEnvKey: &schedulingPolicy.MaxUpcoming,
+	} {
+		v, ok := os.LookupEnv(envKey)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("failed to parse environment variable '%s' as non-negative integer: %q", envKey, v)
+		}
+		*dst = n
+	}
+}
+
+// ScheduleViolation は予約のルールに反したときにecho.HTTPErrorのMessageとして返し、codeを付けてレスポンスする
+type ScheduleViolation struct {
+	Code    string
+	Message string
+}
+
+func (v *ScheduleViolation) String() string {
+	return v.Message
+}
+
+func newScheduleViolation(code, message string) *echo.HTTPError {
+	return echo.NewHTTPError(http.StatusBadRequest, &ScheduleViolation{Code: code, Message: message})
+}
+
+// checkReservationTimeRange は配信の長さと開始までの時間を調べる
+func checkReservationTimeRange(startAt, endAt int64) error {
+	if startAt >= endAt {
+		return newScheduleViolation(scheduleErrorInvalidRange, "bad reservation time range")
+	}
+	if schedulingPolicy.MinDuration > 0 && endAt-startAt < schedulingPolicy.MinDuration {
+		return newScheduleViolation(scheduleErrorTooShort, "a livestream must be at least "+strconv.FormatInt(schedulingPolicy.MinDuration, 10)+" seconds long")
+	}
+	if schedulingPolicy.MaxDuration > 0 && endAt-startAt > schedulingPolicy.MaxDuration {
+		return newScheduleViolation(scheduleErrorTooLong, "a livestream must be at most "+strconv.FormatInt(schedulingPolicy.MaxDuration, 10)+" seconds long")
+	}
+	if schedulingPolicy.MinLeadTime > 0 && reservationDeadlinePassed(startAt) {
+		return newScheduleViolation(scheduleErrorLeadTime, "a livestream must be reserved at least "+strconv.FormatInt(schedulingPolicy.MinLeadTime, 10)+" seconds before it starts")
+	}
+	return nil
+}
+
+// reservationDeadlinePassed は開始までの時間が足りず、もう予約できないかを返す。
+// 開始までの時間のルールがなければ開始した時点で締め切る
+func reservationDeadlinePassed(startAt int64) bool {
+	return startAt-time.Now().Unix() < schedulingPolicy.MinLeadTime
+}
+
+// checkReservationOverlap は配信者のキャンセルされていない他の配信と期間が重ならないか調べる。
+// 重なる区間の予約枠はtakeReservationSlotsでロックされているので、その後に呼べば並行した予約とも重ならない
+func checkReservationOverlap(ctx context.Context, tx *sqlx.Tx, userID, livestreamID, startAt, endAt int64) error {
+	var count int64
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM livestreams l WHERE l.user_id = ? AND l.id != ? AND l.start_at < ? AND l.end_at > ? AND NOT EXISTS (SELECT 1 FROM livestream_states s WHERE s.livestream_id = l.id AND s.status = ?)", userID, livestreamID, endAt, startAt, livestreamStatusCancelled); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count overlapping livestreams: "+err.Error())
+	}
+	if count > 0 {
+		return newScheduleViolation(scheduleErrorOverlapping, "the livestream overlaps with another livestream of the same streamer")
+	}
+	return nil
+}
+
+// checkUpcomingReservations はキャンセルされておらず、まだ始まっていない配信の予約数を調べる
+func checkUpcomingReservations(ctx context.Context, tx *sqlx.Tx, userID int64) error {
+	if schedulingPolicy.MaxUpcoming == 0 {
+		return nil
+	}
+	var count int64
+	if err := tx.GetContext(ctx, &count, "SELECT COUNT(*) FROM livestreams l WHERE l.user_id = ? AND l.start_at > ? AND NOT EXISTS (SELECT 1 FROM livestream_states s WHERE s.livestream_id = l.id AND s.status = ?)", userID, time.Now().Unix(), livestreamStatusCancelled); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count upcoming livestreams: "+err.Error())
+	}
+	if count >= schedulingPolicy.MaxUpcoming {
+		return newScheduleViolation(scheduleErrorTooManyUpcoming, "a streamer can reserve at most "+strconv.FormatInt(schedulingPolicy.MaxUpcoming, 10)+" upcoming livestreams")
+	}
+	return nil
+}
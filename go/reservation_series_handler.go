@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 1つのシリーズで予約できる回数の上限
+const maxSeriesOccurrences = 100
+
+// 繰り返しの間隔
+var recurrenceIntervals = map[string]int64{
+	"daily":  24 * 60 * 60,
+	"weekly": 7 * 24 * 60 * 60,
+}
+
+// RecurrenceRule は繰り返し予約の規則。CountとUntilのどちらか一方を指定する
+type RecurrenceRule struct {
+	// daily, weekly
+	Frequency string `json:"frequency"`
+	// 予約する回数
+	Count int64 `json:"count,omitempty"`
+	// この時刻までに始まる回を予約する
+	Until int64 `json:"until,omitempty"`
+}
+
+// ReserveLivestreamSeriesRequest のstart_at, end_atは初回の配信の期間
+type ReserveLivestreamSeriesRequest struct {
+	ReserveLivestreamRequest
+	Recurrence RecurrenceRule `json:"recurrence"`
+}
+
+type LivestreamSeriesModel struct {
+	ID        int64  `db:"id"`
+	UserID    int64  `db:"user_id"`
+	Frequency string `db:"frequency"`
+	Count     int64  `db:"occurrence_count"`
+	Until     int64  `db:"until_at"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+type LivestreamSeriesLivestreamModel struct {
+	ID           int64 `db:"id"`
+	SeriesID     int64 `db:"series_id"`
+	LivestreamID int64 `db:"livestream_id"`
+}
+
+type LivestreamSeries struct {
+	ID         int64          `json:"id"`
+	Recurrence RecurrenceRule `json:"recurrence"`
+	// キャンセルされた回も含む。start_at順
+	Livestreams []Livestream `json:"livestreams"`
+	CreatedAt   int64        `json:"created_at"`
+}
+
+// ReservationConflict は予約できなかった回
+type ReservationConflict struct {
+	StartAt int64  `json:"start_at"`
+	EndAt   int64  `json:"end_at"`
+	Reason  string `json:"reason"`
+	// 予約のルールに反したときのエラーコード
+	Code string `json:"code,omitempty"`
+}
+
+type ReservationConflictsResponse struct {
+	Error     string                `json:"error"`
+	Conflicts []ReservationConflict `json:"conflicts"`
+}
+
+// occurrences は規則に従って各回の予約リクエストを作る
+func (req *ReserveLivestreamSeriesRequest) occurrences() ([]ReserveLivestreamRequest, error) {
+	interval, ok := recurrenceIntervals[req.Recurrence.Frequency]
+	if !ok {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence frequency must be daily or weekly")
+	}
+	if (req.Recurrence.Count > 0) == (req.Recurrence.Until > 0) {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "either recurrence count or until must be specified")
+	}
+	if req.StartAt >= req.EndAt || req.EndAt-req.StartAt > interval {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	}
+
+	var occurrences []ReserveLivestreamRequest
+	for i := int64(0); ; i++ {
+		if req.Recurrence.Count > 0 && i >= req.Recurrence.Count {
+			break
+		}
+		startAt := req.StartAt + i*interval
+		if req.Recurrence.Until > 0 && startAt > req.Recurrence.Until {
+			break
+		}
+		if len(occurrences) >= maxSeriesOccurrences {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "a series can have at most "+strconv.Itoa(maxSeriesOccurrences)+" occurrences")
+		}
+		occurrence := req.ReserveLivestreamRequest
+		occurrence.StartAt = startAt
+		occurrence.EndAt = req.EndAt + i*interval
+		occurrences = append(occurrences, occurrence)
+	}
+	if len(occurrences) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "recurrence until must not be before start_at")
+	}
+	return occurrences, nil
+}
+
+// reserveLivestreamSeriesHandler は繰り返し予約の全ての回を1つのトランザクションで予約する。
+// 1回でも予約できなければ何も予約せず、予約できなかった回を返す
+func reserveLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ReserveLivestreamSeriesRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	occurrences, err := req.occurrences()
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	seriesModel := LivestreamSeriesModel{
+		UserID:    userID,
+		Frequency: req.Recurrence.Frequency,
+		Count:     req.Recurrence.Count,
+		Until:     req.Recurrence.Until,
+		CreatedAt: time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_series (user_id, frequency, occurrence_count, until_at, created_at) VALUES (:user_id, :frequency, :occurrence_count, :until_at, :created_at)", seriesModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream series: "+err.Error())
+	}
+	if seriesModel.ID, err = rs.LastInsertId(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream series id: "+err.Error())
+	}
+
+	var (
+		livestreamModels []LivestreamModel
+		conflicts        []ReservationConflict
+	)
+	for i := range occurrences {
+		livestreamModel, err := insertReservation(ctx, c, tx, userID, &occurrences[i])
+		if err != nil {
+			var httpErr *echo.HTTPError
+			if errors.As(err, &httpErr) && httpErr.Code == http.StatusBadRequest {
+				// 残りの回も調べて、予約できない回をまとめて返す
+				conflict := ReservationConflict{
+					StartAt: occurrences[i].StartAt,
+					EndAt:   occurrences[i].EndAt,
+					Reason:  fmt.Sprint(httpErr.Message),
+				}
+				if v, ok := httpErr.Message.(*ScheduleViolation); ok {
+					conflict.Code = v.Code
+				}
+				conflicts = append(conflicts, conflict)
+				continue
+			}
+			return err
+		}
+		livestreamModels = append(livestreamModels, *livestreamModel)
+	}
+	if len(conflicts) > 0 {
+		return c.JSON(http.StatusConflict, &ReservationConflictsResponse{
+			Error:     "some occurrences can't be reserved",
+			Conflicts: conflicts,
+		})
+	}
+
+	for _, livestreamModel := range livestreamModels {
+		if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_series_livestreams (series_id, livestream_id) VALUES (:series_id, :livestream_id)", &LivestreamSeriesLivestreamModel{
+			SeriesID:     seriesModel.ID,
+			LivestreamID: livestreamModel.ID,
+		}); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream series livestream: "+err.Error())
+		}
+	}
+
+	series, err := fillLivestreamSeriesResponse(ctx, tx, seriesModel, livestreamModels)
+	if err != nil {
+		return err
+	}
+
+	if err := commitReservation(tx, req.Tags, livestreamModels...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, series)
+}
+
+func getLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	seriesID, err := strconv.Atoi(c.Param("series_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var seriesModel LivestreamSeriesModel
+	if err := tx.GetContext(ctx, &seriesModel, "SELECT * FROM livestream_series WHERE id = ?", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream series not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT l.* FROM livestreams l INNER JOIN livestream_series_livestreams s ON s.livestream_id = l.id WHERE s.series_id = ? ORDER BY l.start_at", seriesModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+
+	series, err := fillLivestreamSeriesResponse(ctx, tx, seriesModel, livestreamModels)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, series)
+}
+
+// cancelLivestreamSeriesHandler はシリーズのうちまだ始まっていない回を全てキャンセルする。
+// 1回ずつのキャンセルは DELETE /api/livestream/:livestream_id で行う
+func cancelLivestreamSeriesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	seriesID, err := strconv.Atoi(c.Param("series_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "series_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var seriesModel LivestreamSeriesModel
+	if err := tx.GetContext(ctx, &seriesModel, "SELECT * FROM livestream_series WHERE id = ?", seriesID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "livestream series not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream series: "+err.Error())
+	}
+	if seriesModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't modify other streamer's livestream")
+	}
+
+	var livestreamModels []LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT l.* FROM livestreams l INNER JOIN livestream_series_livestreams s ON s.livestream_id = l.id WHERE s.series_id = ? AND l.start_at > ? FOR UPDATE", seriesModel.ID, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	// キャンセル済みの回と、開始時刻より前に始めた回は飛ばす
+	var cancelled []LivestreamModel
+	for _, livestreamModel := range livestreamModels {
+		status, err := getLivestreamStatus(ctx, tx, livestreamModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream status: "+err.Error())
+		}
+		if status != livestreamStatusScheduled {
+			continue
+		}
+		if err := cancelReservation(ctx, tx, livestreamModel); err != nil {
+			return err
+		}
+		cancelled = append(cancelled, livestreamModel)
+	}
+
+	if err := commitCancellation(ctx, c, tx, cancelled...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func fillLivestreamSeriesResponse(ctx context.Context, tx *sqlx.Tx, seriesModel LivestreamSeriesModel, livestreamModels []LivestreamModel) (LivestreamSeries, error) {
+	livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return LivestreamSeries{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+	return LivestreamSeries{
+		ID: seriesModel.ID,
+		Recurrence: RecurrenceRule{
+			Frequency: seriesModel.Frequency,
+			Count:     seriesModel.Count,
+			Until:     seriesModel.Until,
+		},
+		Livestreams: livestreams,
+		CreatedAt:   seriesModel.CreatedAt,
+	}, nil
+}
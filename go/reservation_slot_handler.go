@@ -0,0 +1,98 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+type ReservationSlot struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	Slot    int64 `json:"slot"`
+}
+
+// ReservationWindow は続けて予約できる区間。Slotは区間内の予約枠の残数の最小値
+type ReservationWindow struct {
+	StartAt int64 `json:"start_at"`
+	EndAt   int64 `json:"end_at"`
+	Slot    int64 `json:"slot"`
+}
+
+type ReservationSlotsResponse struct {
+	Slots []ReservationSlot `json:"slots"`
+	// 長い順
+	Windows []ReservationWindow `json:"windows"`
+}
+
+// getReservationAvailability は区間に含まれる予約枠の残数と、続けて予約できる区間を返す。
+// reservation_slotsはレプリカに載っているのでDBには行かない
+func getReservationAvailability(ctx context.Context, from, to int64) (ReservationSlotsResponse, error) {
+	var slotModels []ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slotModels, "SELECT * FROM reservation_slots WHERE start_at >= ? AND end_at <= ? ORDER BY start_at", from, to); err != nil {
+		return ReservationSlotsResponse{}, err
+	}
+
+	res := ReservationSlotsResponse{
+		Slots:   make([]ReservationSlot, 0, len(slotModels)),
+		Windows: []ReservationWindow{},
+	}
+	var window *ReservationWindow
+	for _, slotModel := range slotModels {
+		slot := ReservationSlot{StartAt: slotModel.StartAt, EndAt: slotModel.EndAt, Slot: slotModel.Slot}
+		res.Slots = append(res.Slots, slot)
+
+		if slot.Slot < 1 || window != nil && window.EndAt != slot.StartAt {
+			window = nil
+		}
+		if slot.Slot < 1 {
+			continue
+		}
+		if window == nil {
+			res.Windows = append(res.Windows, ReservationWindow{StartAt: slot.StartAt, EndAt: slot.EndAt, Slot: slot.Slot})
+			window = &res.Windows[len(res.Windows)-1]
+			continue
+		}
+		window.EndAt = slot.EndAt
+		window.Slot = min(window.Slot, slot.Slot)
+	}
+	slices.SortStableFunc(res.Windows, func(a, b ReservationWindow) int {
+		return cmp.Compare(b.EndAt-b.StartAt, a.EndAt-a.StartAt)
+	})
+	return res, nil
+}
+
+func getReservationSlotsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// 指定がなければ全ての予約枠
+	var from, to int64 = 0, math.MaxInt64
+	for name, dst := range map[string]*int64{"from": &from, "to": &to} {
+		if v := c.QueryParam(name); v != "" {
+			t, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, name+" query parameter must be integer")
+			}
+			*dst = t
+		}
+	}
+	if from >= to {
+		return echo.NewHTTPError(http.StatusBadRequest, "from must be before to")
+	}
+
+	res, err := getReservationAvailability(ctx, from, to)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
+	}
+	return c.JSON(http.StatusOK, res)
+}
@@ -0,0 +1,406 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// waitlistSweepInterval は予約の締め切りを過ぎたキャンセル待ちを期限切れにする間隔
+const waitlistSweepInterval = 10 * time.Second
+
+const (
+	waitlistStatusWaiting = "waiting"
+	// 予約できた。LivestreamIDに配信が入る
+	waitlistStatusReserved = "reserved"
+	// 予約できないまま予約の締め切りを過ぎた
+	waitlistStatusExpired = "expired"
+	// 予約枠が空いても予約のルールなどに反して予約できない
+	waitlistStatusFailed = "failed"
+	// 配信者がキャンセル待ちをやめた
+	waitlistStatusCancelled = "cancelled"
+)
+
+type WaitlistEntryModel struct {
+	ID           int64  `db:"id"`
+	UserID       int64  `db:"user_id"`
+	Title        string `db:"title"`
+	Description  string `db:"description"`
+	PlaylistUrl  string `db:"playlist_url"`
+	ThumbnailUrl string `db:"thumbnail_url"`
+	// 予約時に付けるタグIDのJSON配列
+	Tags string `db:"tags"`
+	// 予約時に招待するコラボレーターのユーザIDのJSON配列
+	Collaborators string `db:"collaborators"`
+	StartAt       int64  `db:"start_at"`
+	EndAt         int64  `db:"end_at"`
+	Status        string `db:"status"`
+	LivestreamID  int64  `db:"livestream_id"`
+	CreatedAt     int64  `db:"created_at"`
+}
+
+type WaitlistEntry struct {
+	ID            int64   `json:"id"`
+	Title         string  `json:"title"`
+	Description   string  `json:"description"`
+	PlaylistUrl   string  `json:"playlist_url"`
+	ThumbnailUrl  string  `json:"thumbnail_url"`
+	Tags          []int64 `json:"tags"`
+	Collaborators []int64 `json:"collaborators"`
+	StartAt       int64   `json:"start_at"`
+	EndAt         int64   `json:"end_at"`
+	Status        string  `json:"status"`
+	// status=reservedのとき予約された配信のID
+	LivestreamID int64 `json:"livestream_id,omitempty"`
+	CreatedAt    int64 `json:"created_at"`
+}
+
+func (m WaitlistEntryModel) request() (*ReserveLivestreamRequest, error) {
+	req := &ReserveLivestreamRequest{
+		Title:        m.Title,
+		Description:  m.Description,
+		PlaylistUrl:  m.PlaylistUrl,
+		ThumbnailUrl: m.ThumbnailUrl,
+		StartAt:      m.StartAt,
+		EndAt:        m.EndAt,
+	}
+	if err := json.Unmarshal([]byte(m.Tags), &req.Tags); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal([]byte(m.Collaborators), &req.Collaborators); err != nil {
+		return nil, err
+	}
+	return req, nil
+}
+
+func (m WaitlistEntryModel) response() (WaitlistEntry, error) {
+	req, err := m.request()
+	if err != nil {
+		return WaitlistEntry{}, err
+	}
+	return WaitlistEntry{
+		ID:            m.ID,
+		Title:         m.Title,
+		Description:   m.Description,
+		PlaylistUrl:   m.PlaylistUrl,
+		ThumbnailUrl:  m.ThumbnailUrl,
+		Tags:          req.Tags,
+		Collaborators: req.Collaborators,
+		StartAt:       m.StartAt,
+		EndAt:         m.EndAt,
+		Status:        m.Status,
+		LivestreamID:  m.LivestreamID,
+		CreatedAt:     m.CreatedAt,
+	}, nil
+}
+
+// joinWaitlistHandler は予約と同じリクエストでキャンセル待ちに並ぶ。
+// 予約枠の空きを待つ以外に予約できない理由があれば並ばせない。既に空いていればその場で予約される
+func joinWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var req *ReserveLivestreamRequest
+	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil || req == nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	}
+	if err := checkReservationTimeRange(req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+	if err := checkWaitlistRequest(ctx, userID, req); err != nil {
+		return err
+	}
+	if req.Tags == nil {
+		req.Tags = []int64{}
+	}
+	tags, err := json.Marshal(req.Tags)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode tags: "+err.Error())
+	}
+	if req.Collaborators == nil {
+		req.Collaborators = []int64{}
+	}
+	collaborators, err := json.Marshal(req.Collaborators)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to encode collaborators: "+err.Error())
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// どのシーズンにも入らない区間は空くことがない
+	if _, err := findReservationSeason(ctx, tx, req.StartAt, req.EndAt); err != nil {
+		return err
+	}
+
+	entryModel := WaitlistEntryModel{
+		UserID:        userID,
+		Title:         req.Title,
+		Description:   req.Description,
+		PlaylistUrl:   req.PlaylistUrl,
+		ThumbnailUrl:  req.ThumbnailUrl,
+		Tags:          string(tags),
+		Collaborators: string(collaborators),
+		StartAt:       req.StartAt,
+		EndAt:         req.EndAt,
+		Status:        waitlistStatusWaiting,
+		CreatedAt:     time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO reservation_waitlist (user_id, title, description, playlist_url, thumbnail_url, tags, collaborators, start_at, end_at, status, created_at) VALUES (:user_id, :title, :description, :playlist_url, :thumbnail_url, :tags, :collaborators, :start_at, :end_at, :status, :created_at)", entryModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert waitlist entry: "+err.Error())
+	}
+	if entryModel.ID, err = rs.LastInsertId(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted waitlist entry id: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 先に並んでいるキャンセル待ちは予約枠が空いたときに繰り上げているので、ここでは並んだ分だけ試す
+	if err := promoteWaitlistEntry(ctx, c, entryModel.ID); err != nil {
+		c.Logger().Errorf("failed to promote waitlist entry %d: %v", entryModel.ID, err)
+	}
+
+	// 予約されたかどうかを返す
+	if err := dbConn.GetContext(ctx, &entryModel, "SELECT * FROM reservation_waitlist WHERE id = ?", entryModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get waitlist entry: "+err.Error())
+	}
+	entry, err := entryModel.response()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill waitlist entry: "+err.Error())
+	}
+	return c.JSON(http.StatusCreated, entry)
+}
+
+// checkWaitlistRequest は予約枠が空いても変わらない、タグとコラボレーターの指定を調べる
+func checkWaitlistRequest(ctx context.Context, userID int64, req *ReserveLivestreamRequest) error {
+	for _, tagID := range req.Tags {
+		var tagModel TagModel
+		if err := dbConn.GetContext(ctx, &tagModel, "SELECT * FROM tags WHERE id = ?", tagID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, "tag not found: "+strconv.FormatInt(tagID, 10))
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tag: "+err.Error())
+		}
+	}
+	for _, collaboratorID := range req.Collaborators {
+		if collaboratorID == userID {
+			return echo.NewHTTPError(http.StatusBadRequest, "a streamer can't invite themselves as a collaborator")
+		}
+		var userModel UserModel
+		if err := dbConn.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", collaboratorID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, "collaborator not found: "+strconv.FormatInt(collaboratorID, 10))
+			}
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+	}
+	return nil
+}
+
+func getWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	var entryModels []WaitlistEntryModel
+	if err := dbConn.SelectContext(ctx, &entryModels, "SELECT * FROM reservation_waitlist WHERE user_id = ? ORDER BY id DESC", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get waitlist entries: "+err.Error())
+	}
+	entries := make([]WaitlistEntry, len(entryModels))
+	for i, entryModel := range entryModels {
+		entry, err := entryModel.response()
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill waitlist entry: "+err.Error())
+		}
+		entries[i] = entry
+	}
+	return c.JSON(http.StatusOK, entries)
+}
+
+func leaveWaitlistHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	entryID, err := strconv.Atoi(c.Param("entry_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "entry_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var entryModel WaitlistEntryModel
+	if err := tx.GetContext(ctx, &entryModel, "SELECT * FROM reservation_waitlist WHERE id = ? FOR UPDATE", entryID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "waitlist entry not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get waitlist entry: "+err.Error())
+	}
+	if entryModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't leave other streamer's waitlist entry")
+	}
+	if entryModel.Status != waitlistStatusWaiting {
+		return echo.NewHTTPError(http.StatusBadRequest, "waitlist entry is already "+entryModel.Status)
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, livestream_id = ? WHERE id = ?", waitlistStatusCancelled, 0, entryModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update waitlist entry: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+	return c.NoContent(http.StatusNoContent)
+}
+
+// promoteWaitlist は予約枠が空いた区間に重なるキャンセル待ちを、並んだ順に予約できるだけ予約する。
+// 空けた側の処理は済んでいるので、失敗してもログに残すだけにする
+func promoteWaitlist(ctx context.Context, c echo.Context, startAt, endAt int64) {
+	var entryIDs []int64
+	if err := dbConn.SelectContext(ctx, &entryIDs, "SELECT id FROM reservation_waitlist WHERE status = ? AND start_at < ? AND end_at > ? ORDER BY id", waitlistStatusWaiting, endAt, startAt); err != nil {
+		c.Logger().Errorf("failed to get waitlist entries: %v", err)
+		return
+	}
+	for _, entryID := range entryIDs {
+		if err := promoteWaitlistEntry(ctx, c, entryID); err != nil {
+			c.Logger().Errorf("failed to promote waitlist entry %d: %v", entryID, err)
+		}
+	}
+}
+
+func promoteWaitlistEntry(ctx context.Context, c echo.Context, entryID int64) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// 並行して空いたときに二重に予約しないよう、状態をロックして確かめ直す
+	var entryModel WaitlistEntryModel
+	if err := tx.GetContext(ctx, &entryModel, "SELECT * FROM reservation_waitlist WHERE id = ? FOR UPDATE", entryID); err != nil {
+		return err
+	}
+	if entryModel.Status != waitlistStatusWaiting {
+		return nil
+	}
+
+	req, err := entryModel.request()
+	if err != nil {
+		return err
+	}
+	livestreamModel, err := insertReservation(ctx, c, tx, entryModel.UserID, req)
+	if err != nil {
+		var httpErr *echo.HTTPError
+		if !errors.As(err, &httpErr) || httpErr.Code != http.StatusBadRequest {
+			return err
+		}
+		// 予約の途中まで書いているので捨ててから、待ち続けるかどうかを決める
+		tx.Rollback()
+		switch {
+		case reservationDeadlinePassed(entryModel.StartAt):
+			return closeWaitlistEntry(ctx, entryModel.ID, waitlistStatusExpired)
+		case waitsForReservationSlot(httpErr):
+			return nil
+		default:
+			return closeWaitlistEntry(ctx, entryModel.ID, waitlistStatusFailed)
+		}
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, livestream_id = ? WHERE id = ?", waitlistStatusReserved, livestreamModel.ID, entryModel.ID); err != nil {
+		return err
+	}
+	return commitReservation(tx, req.Tags, *livestreamModel)
+}
+
+// waitsForReservationSlot は予約できなかった理由が、予約枠か配信者の他の配信が空けば解消するものかを返す
+func waitsForReservationSlot(httpErr *echo.HTTPError) bool {
+	violation, ok := httpErr.Message.(*ScheduleViolation)
+	if !ok {
+		// コラボレーターの指定の誤りなど
+		return false
+	}
+	return violation.Code == scheduleErrorSlotFullyBooked || violation.Code == scheduleErrorOverlapping
+}
+
+// closeWaitlistEntry はまだ待っているキャンセル待ちを期限切れか失敗にする
+func closeWaitlistEntry(ctx context.Context, entryID int64, status string) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var entryModel WaitlistEntryModel
+	if err := tx.GetContext(ctx, &entryModel, "SELECT * FROM reservation_waitlist WHERE id = ? FOR UPDATE", entryID); err != nil {
+		return err
+	}
+	if entryModel.Status != waitlistStatusWaiting {
+		return nil
+	}
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_waitlist SET status = ?, livestream_id = ? WHERE id = ?", status, 0, entryModel.ID); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// sweepWaitlist は定期的に予約の締め切りを過ぎたキャンセル待ちを期限切れにする。
+// 繰り上げは予約枠が空いたときにだけ行うので、枠が空かないまま締め切りを過ぎたものはここで拾う
+func sweepWaitlist(e *echo.Echo) {
+	ticker := time.NewTicker(waitlistSweepInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ctx := context.Background()
+		var entryIDs []int64
+		// reservationDeadlinePassedと同じ締め切り
+		if err := dbConn.SelectContext(ctx, &entryIDs, "SELECT id FROM reservation_waitlist WHERE status = ? AND start_at < ?", waitlistStatusWaiting, time.Now().Unix()+schedulingPolicy.MinLeadTime); err != nil {
+			e.Logger.Errorf("failed to get waitlist entries: %v", err)
+			continue
+		}
+		for _, entryID := range entryIDs {
+			if err := closeWaitlistEntry(ctx, entryID, waitlistStatusExpired); err != nil {
+				e.Logger.Errorf("failed to expire waitlist entry %d: %v", entryID, err)
+			}
+		}
+	}
+}
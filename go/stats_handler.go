@@ -1,12 +1,14 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"net/http"
 	"sort"
 	"strconv"
 
+	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
 )
 
@@ -16,6 +18,11 @@ type LivestreamStatistics struct {
 	TotalReactions int64 `json:"total_reactions"`
 	TotalReports   int64 `json:"total_reports"`
 	MaxTip         int64 `json:"max_tip"`
+	// 視聴中の視聴者数と、同時視聴者数の最大値
+	CurrentViewers int64 `json:"current_viewers"`
+	PeakViewers    int64 `json:"peak_viewers"`
+	// 視聴者の累計視聴時間 (秒)
+	TotalWatchSeconds int64 `json:"total_watch_seconds"`
 }
 
 type LivestreamRankingEntry struct {
@@ -41,6 +48,8 @@ type UserStatistics struct {
 	TotalLivecomments int64  `json:"total_livecomments"`
 	TotalTip          int64  `json:"total_tip"`
 	FavoriteEmoji     string `json:"favorite_emoji"`
+	// 配信が視聴された累計時間 (秒)
+	TotalWatchSeconds int64 `json:"total_watch_seconds"`
 }
 
 type UserRankingEntry struct {
@@ -86,6 +95,24 @@ func getUserStatisticsHandler(c echo.Context) error {
 		}
 	}
 
+	// キャンセルされた配信の分は数えない。配信者ごとの分を一度だけ数えておき、配信者ごとの集計から差し引く
+	cancelledModels, err := getCancelledLivestreams(ctx, tx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get cancelled livestreams: "+err.Error())
+	}
+	cancelled := make(map[int64]struct{}, len(cancelledModels))
+	cancelledReactions := make(map[int64]int64)
+	cancelledTips := make(map[int64]int64)
+	for _, livestream := range cancelledModels {
+		cancelled[livestream.ID] = struct{}{}
+		reactions, tips, err := countLivestreamScore(ctx, tx, livestream.ID)
+		if err != nil {
+			return err
+		}
+		cancelledReactions[livestream.UserID] += reactions
+		cancelledTips[livestream.UserID] += tips
+	}
+
 	// ランク算出
 	var users []*UserModel
 	if err := tx.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
@@ -114,7 +141,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
 		}
 
-		score := reactions + tips
+		score := reactions - cancelledReactions[user.ID] + tips - cancelledTips[user.ID]
 		ranking = append(ranking, UserRankingEntry{
 			Username: user.Name,
 			Score:    score,
@@ -141,14 +168,23 @@ func getUserStatisticsHandler(c echo.Context) error {
 	if err := tx.GetContext(ctx, &totalReactions, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
 	}
+	totalReactions -= cancelledReactions[user.ID]
 
 	// ライブコメント数、チップ合計
 	var totalLivecomments int64
 	var totalTip int64
-	var livestreams []*LivestreamModel
-	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+	var userLivestreams []*LivestreamModel
+	if err := tx.SelectContext(ctx, &userLivestreams, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
+	var livestreams []*LivestreamModel
+	var livestreamIDs []int64
+	for _, livestream := range userLivestreams {
+		if _, ok := cancelled[livestream.ID]; !ok {
+			livestreams = append(livestreams, livestream)
+			livestreamIDs = append(livestreamIDs, livestream.ID)
+		}
+	}
 
 	for _, livestream := range livestreams {
 		var livecomments []*LivecommentModel
@@ -172,20 +208,25 @@ func getUserStatisticsHandler(c echo.Context) error {
 		viewersCount += cnt
 	}
 
-	// お気に入り絵文字
+	// 累計視聴時間とお気に入り絵文字は、キャンセルされていない配信に絞って引く
+	var totalWatchSeconds int64
 	var favoriteEmoji string
-	query = `
-	SELECT r.emoji_name
-	FROM users u
-	INNER JOIN livestreams l ON l.user_id = u.id
-	INNER JOIN reactions r ON r.livestream_id = l.id
-	WHERE u.name = ?
-	GROUP BY emoji_name
-	ORDER BY COUNT(*) DESC, emoji_name DESC
-	LIMIT 1
-	`
-	if err := tx.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+	if len(livestreamIDs) > 0 {
+		query, args, err := sqlx.In("SELECT IFNULL(SUM(watch_seconds), 0) FROM livestream_watch_times WHERE livestream_id IN (?)", livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		}
+		if err := tx.GetContext(ctx, &totalWatchSeconds, query, args...); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum watch times: "+err.Error())
+		}
+
+		query, args, err = sqlx.In("SELECT emoji_name FROM reactions WHERE livestream_id IN (?) GROUP BY emoji_name ORDER BY COUNT(*) DESC, emoji_name DESC LIMIT 1", livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		}
+		if err := tx.GetContext(ctx, &favoriteEmoji, query, args...); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+		}
 	}
 
 	stats := UserStatistics{
@@ -195,6 +236,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 		TotalLivecomments: totalLivecomments,
 		TotalTip:          totalTip,
 		FavoriteEmoji:     favoriteEmoji,
+		TotalWatchSeconds: totalWatchSeconds,
 	}
 	return c.JSON(http.StatusOK, stats)
 }
@@ -226,23 +268,37 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
 	}
+	// キャンセルされた配信は統計もランキングも出さない
+	state, err := getLivestreamState(ctx, tx, livestreamID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream status: "+err.Error())
+	}
+	if state == livestreamStatusCancelled {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of cancelled livestream")
+	}
 
 	var livestreams []*LivestreamModel
 	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
+	cancelledModels, err := getCancelledLivestreams(ctx, tx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get cancelled livestreams: "+err.Error())
+	}
+	cancelled := make(map[int64]struct{}, len(cancelledModels))
+	for _, livestream := range cancelledModels {
+		cancelled[livestream.ID] = struct{}{}
+	}
 
 	// ランク算出
 	var ranking LivestreamRanking
 	for _, livestream := range livestreams {
-		var reactions int64
-		if err := tx.GetContext(ctx, &reactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+		if _, ok := cancelled[livestream.ID]; ok {
+			continue
 		}
-
-		var totalTips int64
-		if err := tx.GetContext(ctx, &totalTips, "SELECT IFNULL(SUM(l2.tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l.id = l2.livestream_id WHERE l.id = ?", livestream.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
+		reactions, totalTips, err := countLivestreamScore(ctx, tx, livestream.ID)
+		if err != nil {
+			return err
 		}
 
 		score := reactions + totalTips
@@ -286,15 +342,36 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
 	}
 
+	// 累計視聴時間
+	var totalWatchSeconds int64
+	if err := tx.GetContext(ctx, &totalWatchSeconds, "SELECT IFNULL(SUM(watch_seconds), 0) FROM livestream_watch_times WHERE livestream_id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to sum watch times: "+err.Error())
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	presence := viewerPresence.presence(livestreamID)
 	return c.JSON(http.StatusOK, LivestreamStatistics{
-		Rank:           rank,
-		ViewersCount:   viewersCount,
-		MaxTip:         maxTip,
-		TotalReactions: totalReactions,
-		TotalReports:   totalReports,
+		Rank:              rank,
+		ViewersCount:      viewersCount,
+		MaxTip:            maxTip,
+		TotalReactions:    totalReactions,
+		TotalReports:      totalReports,
+		CurrentViewers:    presence.CurrentViewers,
+		PeakViewers:       presence.PeakViewers,
+		TotalWatchSeconds: totalWatchSeconds,
 	})
 }
+
+// countLivestreamScore は配信のリアクション数とチップの合計を数える
+func countLivestreamScore(ctx context.Context, tx *sqlx.Tx, livestreamID int64) (reactions, tips int64, err error) {
+	if err := tx.GetContext(ctx, &reactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON l.id = r.livestream_id WHERE l.id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to count reactions: "+err.Error())
+	}
+	if err := tx.GetContext(ctx, &tips, "SELECT IFNULL(SUM(l2.tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l.id = l2.livestream_id WHERE l.id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, 0, echo.NewHTTPError(http.StatusInternalServerError, "failed to count tips: "+err.Error())
+	}
+	return reactions, tips, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 視聴者はこの間隔でハートビートを送る
+	viewerHeartbeatInterval = 15 * time.Second
+	// これ以上ハートビートのない視聴は離脱したとみなす
+	viewerSessionTimeout = 3 * viewerHeartbeatInterval
+)
+
+// LivestreamWatchTimeModel は視聴者ごとの配信の視聴記録。退室しても消さない
+type LivestreamWatchTimeModel struct {
+	ID             int64 `db:"id"`
+	UserID         int64 `db:"user_id"`
+	LivestreamID   int64 `db:"livestream_id"`
+	WatchSeconds   int64 `db:"watch_seconds"`
+	FirstEnteredAt int64 `db:"first_entered_at"`
+	LastSeenAt     int64 `db:"last_seen_at"`
+}
+
+// LivestreamPresence は配信の現在の視聴者数と、同時視聴者数の最大値
+type LivestreamPresence struct {
+	LivestreamID   int64 `json:"livestream_id"`
+	CurrentViewers int64 `json:"current_viewers"`
+	PeakViewers    int64 `json:"peak_viewers"`
+}
+
+// viewerSession は入室してから退室するか、ハートビートが途切れるまでの視聴
+type viewerSession struct {
+	LivestreamID int64
+	UserID       int64
+	EnteredAt    time.Time
+	LastSeenAt   time.Time
+	// 退室を記録している間はtrue。タイムアウトで二重に記録しないようにする
+	exiting bool
+}
+
+func (s *viewerSession) watchSeconds() int64 {
+	return int64(s.LastSeenAt.Sub(s.EnteredAt) / time.Second)
+}
+
+// presenceTracker は配信ごとの視聴中のユーザ。同時視聴者数の最大値は初期化するまで覚えておく
+type presenceTracker struct {
+	mu sync.Mutex
+	// 配信ごと、ユーザごとの視聴。視聴者がいなくなった配信は消す
+	viewers map[int64]map[int64]*viewerSession
+	peaks   map[int64]int64
+}
+
+var viewerPresence = &presenceTracker{
+	viewers: make(map[int64]map[int64]*viewerSession),
+	peaks:   make(map[int64]int64),
+}
+
+func (t *presenceTracker) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	clear(t.viewers)
+	clear(t.peaks)
+}
+
+// enter は視聴を始める。視聴中に入室し直したときは同じ視聴を続ける
+func (t *presenceTracker) enter(livestreamID, userID int64, now time.Time) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	viewers, ok := t.viewers[livestreamID]
+	if !ok {
+		viewers = make(map[int64]*viewerSession)
+		t.viewers[livestreamID] = viewers
+	}
+	if s, ok := viewers[userID]; ok {
+		s.LastSeenAt = now
+		return
+	}
+	viewers[userID] = &viewerSession{
+		LivestreamID: livestreamID,
+		UserID:       userID,
+		EnteredAt:    now,
+		LastSeenAt:   now,
+	}
+	t.peaks[livestreamID] = max(t.peaks[livestreamID], int64(len(viewers)))
+}
+
+// heartbeat は視聴中なら最終確認時刻を更新してtrueを返す
+func (t *presenceTracker) heartbeat(livestreamID, userID int64, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.viewers[livestreamID][userID]
+	if !ok {
+		return false
+	}
+	s.LastSeenAt = now
+	return true
+}
+
+// beginExit は退室を始めて、nowまでの視聴を返す。視聴記録に加えたらfinishExitを呼ぶ
+func (t *presenceTracker) beginExit(livestreamID, userID int64, now time.Time) (viewerSession, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s, ok := t.viewers[livestreamID][userID]
+	if !ok || s.exiting {
+		return viewerSession{}, false
+	}
+	s.exiting = true
+	s.LastSeenAt = now
+	return *s, true
+}
+
+// finishExit はbeginExitかexpireした視聴を、記録できていれば終え、できなければ視聴中に戻す
+func (t *presenceTracker) finishExit(livestreamID, userID int64, recorded bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	viewers := t.viewers[livestreamID]
+	s, ok := viewers[userID]
+	if !ok || !s.exiting {
+		return
+	}
+	if !recorded {
+		s.exiting = false
+		return
+	}
+	delete(viewers, userID)
+	if len(viewers) == 0 {
+		delete(t.viewers, livestreamID)
+	}
+}
+
+// expire は最終確認時刻がdeadlineより前の視聴の退室を始めて返す。視聴時間は最終確認時刻までとする。
+// beginExitと同じく、視聴記録に加えたらfinishExitを呼ぶ
+func (t *presenceTracker) expire(deadline time.Time) []viewerSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var expired []viewerSession
+	for _, viewers := range t.viewers {
+		for _, s := range viewers {
+			if !s.exiting && s.LastSeenAt.Before(deadline) {
+				s.exiting = true
+				expired = append(expired, *s)
+			}
+		}
+	}
+	return expired
+}
+
+// sessionsOf はユーザが視聴中の視聴を配信ごとに返す
+func (t *presenceTracker) sessionsOf(userID int64) map[int64]viewerSession {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sessions := make(map[int64]viewerSession)
+	for livestreamID, viewers := range t.viewers {
+		if s, ok := viewers[userID]; ok {
+			sessions[livestreamID] = *s
+		}
+	}
+	return sessions
+}
+
+func (t *presenceTracker) presence(livestreamID int64) LivestreamPresence {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return LivestreamPresence{
+		LivestreamID:   livestreamID,
+		CurrentViewers: int64(len(t.viewers[livestreamID])),
+		PeakViewers:    t.peaks[livestreamID],
+	}
+}
+
+// recordWatch は視聴を視聴記録に加える。入室時は視聴時間0の視聴として記録する
+func recordWatch(ctx context.Context, db sqlx.ExecerContext, s viewerSession) error {
+	_, err := db.ExecContext(ctx, "INSERT INTO livestream_watch_times (user_id, livestream_id, watch_seconds, first_entered_at, last_seen_at) VALUES (?, ?, ?, ?, ?) ON DUPLICATE KEY UPDATE watch_seconds = watch_seconds + VALUES(watch_seconds), last_seen_at = GREATEST(last_seen_at, VALUES(last_seen_at))", s.UserID, s.LivestreamID, s.watchSeconds(), s.EnteredAt.Unix(), s.LastSeenAt.Unix())
+	return err
+}
+
+// saveWatchTimes はexpireした視聴を1件ずつ視聴記録に加えて終える。
+// 失敗した視聴は視聴中に戻し、次のexpireで加え直す。失敗した視聴があっても残りは加える
+func saveWatchTimes(ctx context.Context, sessions []viewerSession) error {
+	var errs []error
+	for _, s := range sessions {
+		err := recordWatch(ctx, dbConn, s)
+		viewerPresence.finishExit(s.LivestreamID, s.UserID, err == nil)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("user %d, livestream %d: %w", s.UserID, s.LivestreamID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// expireViewerSessions はハートビートの途切れた視聴を定期的に終える
+func expireViewerSessions() {
+	ticker := time.NewTicker(viewerHeartbeatInterval)
+	defer ticker.Stop()
+	for now := range ticker.C {
+		expired := viewerPresence.expire(now.Add(-viewerSessionTimeout))
+		if err := saveWatchTimes(context.Background(), expired); err != nil {
+			log.Printf("failed to save watch times of expired viewers: %v", err)
+		}
+	}
+}
+
+// flushViewerSessions は終了時に視聴中の視聴をすべて終えて保存する
+func flushViewerSessions(ctx context.Context) error {
+	return saveWatchTimes(ctx, viewerPresence.expire(time.Now().Add(time.Nanosecond)))
+}
+
+// heartbeatLivestreamHandler は視聴を続けていることを知らせ、現在の視聴者数を返す
+func heartbeatLivestreamHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	// タイムアウトした視聴は入室し直す
+	if !viewerPresence.heartbeat(int64(livestreamID), userID, time.Now()) {
+		return echo.NewHTTPError(http.StatusNotFound, "not watching the livestream; enter it again")
+	}
+
+	return c.JSON(http.StatusOK, viewerPresence.presence(int64(livestreamID)))
+}
+
+func getLivestreamViewersHandler(c echo.Context) error {
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+	}
+
+	return c.JSON(http.StatusOK, viewerPresence.presence(int64(livestreamID)))
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// WatchHistoryEntry は視聴した配信と、その配信の視聴記録
+type WatchHistoryEntry struct {
+	Livestream     Livestream `json:"livestream"`
+	FirstEnteredAt int64      `json:"first_entered_at"`
+	LastSeenAt     int64      `json:"last_seen_at"`
+	// 累計視聴時間 (秒)
+	WatchSeconds int64 `json:"watch_seconds"`
+}
+
+// RecentStreamer は最近視聴した配信者と、その配信者の配信の視聴記録をまとめたもの
+type RecentStreamer struct {
+	Streamer     User  `json:"streamer"`
+	LastSeenAt   int64 `json:"last_seen_at"`
+	WatchSeconds int64 `json:"watch_seconds"`
+}
+
+// getLivestreamModels は配信をまとめて引き、IDごとに返す
+func getLivestreamModels(ctx context.Context, tx *sqlx.Tx, livestreamIDs []int64) (map[int64]LivestreamModel, error) {
+	livestreamModels := make(map[int64]LivestreamModel, len(livestreamIDs))
+	if len(livestreamIDs) == 0 {
+		return livestreamModels, nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	var models []LivestreamModel
+	if err := tx.SelectContext(ctx, &models, query, args...); err != nil {
+		return nil, err
+	}
+	for _, livestreamModel := range models {
+		livestreamModels[livestreamModel.ID] = livestreamModel
+	}
+	return livestreamModels, nil
+}
+
+// getMyWatchHistoryHandler は視聴した配信を最後に視聴した順に返す
+func getMyWatchHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	page, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 並び順とカーソルには保存された最終視聴時刻を使う。視聴中の視聴の分は視聴時間にだけ足す
+	pageCond, pageArgs := page.sql("last_seen_at", "id", true)
+	var watchTimeModels []LivestreamWatchTimeModel
+	if err := tx.SelectContext(ctx, &watchTimeModels, "SELECT * FROM livestream_watch_times WHERE user_id = ?"+pageCond, append([]any{userID}, pageArgs...)...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch history: "+err.Error())
+	}
+	watchTimeModels = cutPage(c, page, watchTimeModels, func(m LivestreamWatchTimeModel) pageKey {
+		return pageKey{CreatedAt: m.LastSeenAt, ID: m.ID}
+	})
+
+	livestreamIDs := make([]int64, len(watchTimeModels))
+	for i, watchTimeModel := range watchTimeModels {
+		livestreamIDs[i] = watchTimeModel.LivestreamID
+	}
+	livestreamModelsByID, err := getLivestreamModels(ctx, tx, livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	livestreamModels := make([]LivestreamModel, len(watchTimeModels))
+	for i, watchTimeModel := range watchTimeModels {
+		livestreamModel, ok := livestreamModelsByID[watchTimeModel.LivestreamID]
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+sql.ErrNoRows.Error())
+		}
+		livestreamModels[i] = livestreamModel
+	}
+	livestreams, err := fillLivestreamsResponse(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	sessions := viewerPresence.sessionsOf(userID)
+	entries := make([]WatchHistoryEntry, len(watchTimeModels))
+	for i, watchTimeModel := range watchTimeModels {
+		watchSeconds := watchTimeModel.WatchSeconds
+		if s, ok := sessions[watchTimeModel.LivestreamID]; ok {
+			watchSeconds += s.watchSeconds()
+		}
+		entries[i] = WatchHistoryEntry{
+			Livestream:     livestreams[i],
+			FirstEnteredAt: watchTimeModel.FirstEnteredAt,
+			LastSeenAt:     watchTimeModel.LastSeenAt,
+			WatchSeconds:   watchSeconds,
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, entries)
+}
+
+// getMyRecentStreamersHandler は視聴記録から、配信を視聴した配信者を最後に視聴した順に返す。自分は含めない
+func getMyRecentStreamersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := sess.Values[defaultUserIDKey].(int64)
+
+	page, err := parsePageRequest(c)
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 配信者ごとにまとめる。並び順とカーソルには保存された最終視聴時刻を使う
+	type streamerWatch struct {
+		StreamerID   int64 `db:"streamer_id"`
+		LastSeenAt   int64 `db:"last_watched_at"`
+		WatchSeconds int64 `db:"watch_seconds"`
+	}
+	pageCond, pageArgs := page.sql("last_watched_at", "streamer_id", true)
+	var watches []streamerWatch
+	query := "SELECT l.user_id AS streamer_id, MAX(w.last_seen_at) AS last_watched_at, SUM(w.watch_seconds) AS watch_seconds" +
+		" FROM livestream_watch_times w INNER JOIN livestreams l ON l.id = w.livestream_id" +
+		" WHERE w.user_id = ? AND l.user_id <> ? GROUP BY l.user_id HAVING 1 = 1" + pageCond
+	if err := tx.SelectContext(ctx, &watches, query, append([]any{userID, userID}, pageArgs...)...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get watch history: "+err.Error())
+	}
+	watches = cutPage(c, page, watches, func(r streamerWatch) pageKey {
+		return pageKey{CreatedAt: r.LastSeenAt, ID: r.StreamerID}
+	})
+
+	// 視聴中の視聴の分を視聴時間に足す
+	sessions := viewerPresence.sessionsOf(userID)
+	sessionLivestreamIDs := make([]int64, 0, len(sessions))
+	for livestreamID := range sessions {
+		sessionLivestreamIDs = append(sessionLivestreamIDs, livestreamID)
+	}
+	sessionLivestreams, err := getLivestreamModels(ctx, tx, sessionLivestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	watching := make(map[int64]int64, len(sessions))
+	for livestreamID, s := range sessions {
+		if livestreamModel, ok := sessionLivestreams[livestreamID]; ok {
+			watching[livestreamModel.UserID] += s.watchSeconds()
+		}
+	}
+
+	streamers := make([]RecentStreamer, len(watches))
+	for i, r := range watches {
+		var userModel UserModel
+		if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", r.StreamerID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+		streamer, err := fillUserResponse(ctx, tx, userModel)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		streamers[i] = RecentStreamer{
+			Streamer:     streamer,
+			LastSeenAt:   r.LastSeenAt,
+			WatchSeconds: r.WatchSeconds + watching[r.StreamerID],
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, streamers)
+}
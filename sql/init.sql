@@ -1,7 +1,10 @@
 TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
 TRUNCATE TABLE reservation_slots;
+TRUNCATE TABLE reservation_seasons;
+TRUNCATE TABLE reservation_waitlist;
 TRUNCATE TABLE livestream_viewers_history;
+TRUNCATE TABLE livestream_watch_times;
 TRUNCATE TABLE livecomment_reports;
 TRUNCATE TABLE ng_words;
 TRUNCATE TABLE reactions;
@@ -9,17 +12,28 @@ TRUNCATE TABLE tags;
 TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
 TRUNCATE TABLE livestreams;
+TRUNCATE TABLE livestream_states;
+TRUNCATE TABLE livestream_series;
+TRUNCATE TABLE livestream_series_livestreams;
+TRUNCATE TABLE livestream_cohosts;
 TRUNCATE TABLE users;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
 ALTER TABLE `reservation_slots` auto_increment = 1;
+ALTER TABLE `reservation_seasons` auto_increment = 1;
+ALTER TABLE `reservation_waitlist` auto_increment = 1;
 ALTER TABLE `livestream_tags` auto_increment = 1;
 ALTER TABLE `livestream_viewers_history` auto_increment = 1;
+ALTER TABLE `livestream_watch_times` auto_increment = 1;
 ALTER TABLE `livecomment_reports` auto_increment = 1;
 ALTER TABLE `ng_words` auto_increment = 1;
 ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
+ALTER TABLE `livestream_states` auto_increment = 1;
+ALTER TABLE `livestream_series` auto_increment = 1;
+ALTER TABLE `livestream_series_livestreams` auto_increment = 1;
+ALTER TABLE `livestream_cohosts` auto_increment = 1;
 ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
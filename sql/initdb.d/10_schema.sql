@@ -4,10 +4,17 @@ DROP TABLE IF EXISTS `users`;
 DROP TABLE IF EXISTS `icons`;
 DROP TABLE IF EXISTS `themes`;
 DROP TABLE IF EXISTS `livestreams`;
+DROP TABLE IF EXISTS `livestream_states`;
+DROP TABLE IF EXISTS `livestream_series`;
+DROP TABLE IF EXISTS `livestream_series_livestreams`;
+DROP TABLE IF EXISTS `livestream_cohosts`;
 DROP TABLE IF EXISTS `reservation_slots`;
+DROP TABLE IF EXISTS `reservation_seasons`;
+DROP TABLE IF EXISTS `reservation_waitlist`;
 DROP TABLE IF EXISTS `tags`;
 DROP TABLE IF EXISTS `livestream_tags`;
 DROP TABLE IF EXISTS `livestream_viewers_history`;
+DROP TABLE IF EXISTS `livestream_watch_times`;
 DROP TABLE IF EXISTS `livecomments`;
 DROP TABLE IF EXISTS `livecomment_reports`;
 DROP TABLE IF EXISTS `ng_words`;
@@ -52,6 +59,58 @@ CREATE TABLE `livestreams` (
   INDEX `idx_user_id` (`user_id`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- 配信者の操作で決まったライブ配信の状態 (live, ended, cancelled)。行がなければ期間だけで決まる
+CREATE TABLE `livestream_states` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `status` VARCHAR(255) NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 繰り返し予約
+CREATE TABLE `livestream_series` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  -- daily, weekly
+  `frequency` VARCHAR(255) NOT NULL,
+  -- 回数で指定されたとき以外は0
+  `occurrence_count` BIGINT NOT NULL DEFAULT 0,
+  -- 終わりの時刻で指定されたとき以外は0
+  `until_at` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 繰り返し予約とライブ配信の中間テーブル
+CREATE TABLE `livestream_series_livestreams` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `series_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  INDEX `idx_series_id` (`series_id`),
+  INDEX `idx_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信のコラボレーター
+CREATE TABLE `livestream_cohosts` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  -- invited, accepted
+  `status` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_id_user_id` (`livestream_id`, `user_id`),
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- ライブ配信を予約できる期間 (シーズン)
+CREATE TABLE `reservation_seasons` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `name` VARCHAR(255) NOT NULL,
+  `start_at` BIGINT NOT NULL,
+  `end_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- ライブ配信予約枠
 CREATE TABLE `reservation_slots` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -61,6 +120,29 @@ CREATE TABLE `reservation_slots` (
   INDEX `start_at_end_at` (`start_at`, `end_at`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- 予約枠のキャンセル待ち
+CREATE TABLE `reservation_waitlist` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `title` VARCHAR(255) NOT NULL,
+  `description` text NOT NULL,
+  `playlist_url` VARCHAR(255) NOT NULL,
+  `thumbnail_url` VARCHAR(255) NOT NULL,
+  -- 予約時に付けるタグIDのJSON配列
+  `tags` TEXT NOT NULL,
+  -- 予約時に招待するコラボレーターのユーザIDのJSON配列
+  `collaborators` TEXT NOT NULL,
+  `start_at` BIGINT NOT NULL,
+  `end_at` BIGINT NOT NULL,
+  -- waiting, reserved, expired, failed, cancelled
+  `status` VARCHAR(255) NOT NULL,
+  -- 予約された配信 (reservedのときのみ)
+  `livestream_id` BIGINT NOT NULL DEFAULT 0,
+  `created_at` BIGINT NOT NULL,
+  INDEX `idx_status_start_at` (`status`, `start_at`),
+  INDEX `idx_user_id` (`user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- ライブストリームに付与される、サービスで定義されたタグ
 CREATE TABLE `tags` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -85,6 +167,19 @@ CREATE TABLE `livestream_viewers_history` (
   `created_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
+-- ライブ配信の視聴者ごとの視聴記録 (視聴履歴)
+CREATE TABLE `livestream_watch_times` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `watch_seconds` BIGINT NOT NULL,
+  `first_entered_at` BIGINT NOT NULL,
+  `last_seen_at` BIGINT NOT NULL,
+  UNIQUE `uniq_user_livestream` (`user_id`, `livestream_id`),
+  INDEX `idx_user_id_last_seen_at` (`user_id`, `last_seen_at`),
+  INDEX `idx_livestream_id` (`livestream_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
 -- ライブ配信に対するライブコメント
 CREATE TABLE `livecomments` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
@@ -0,0 +1,3 @@
+INSERT INTO reservation_seasons (name, start_at, end_at)
+VALUES
+	('2023-2024', 1700874000, 1732496400);